@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/treeder/gotils/v2"
+)
+
+const (
+	defaultBanWindow      = time.Minute
+	defaultBanDuration    = time.Minute
+	defaultMaxBanDuration = 24 * time.Hour
+)
+
+const jsonRPCBanned = -32005
+
+func jsonRPCBan(id json.RawMessage, until time.Time) interface{} {
+	return jsonRPCError(id, jsonRPCBanned, fmt.Sprintf("You are temporarily banned for abuse, until %s", until.UTC().Format(time.RFC3339)))
+}
+
+type offender struct {
+	name        string // Shown instead of the id.
+	rejections  int    // Within the current window.
+	windowStart time.Time
+	bans        int // Consecutive bans, which double in length.
+	bannedUntil time.Time
+}
+
+// abuseDetector bans visitors whose requests are rejected too often. Each ban
+// lasts twice as long as the previous one, until the visitor behaves for
+// maxBan.
+type abuseDetector struct {
+	threshold int // Rejections within window which trigger a ban. 0 disables.
+	window    time.Duration
+	ban       time.Duration
+	maxBan    time.Duration
+
+	mu        sync.Mutex
+	offenders map[string]*offender
+}
+
+func newAbuseDetector(cfg *ConfigData) *abuseDetector {
+	a := &abuseDetector{
+		threshold: cfg.BanThreshold,
+		window:    cfg.BanWindow,
+		ban:       cfg.BanDuration,
+		maxBan:    cfg.MaxBanDuration,
+		offenders: make(map[string]*offender),
+	}
+	if a.window <= 0 {
+		a.window = defaultBanWindow
+	}
+	if a.ban <= 0 {
+		a.ban = defaultBanDuration
+	}
+	if a.maxBan <= 0 {
+		a.maxBan = defaultMaxBanDuration
+	}
+	return a
+}
+
+func (a *abuseDetector) enabled() bool {
+	return a != nil && a.threshold > 0
+}
+
+// banned returns when the ban of visitor id ends, or false if it isn't banned.
+func (a *abuseDetector) banned(id string) (time.Time, bool) {
+	if a == nil {
+		return time.Time{}, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	o, ok := a.offenders[id]
+	if !ok || !time.Now().Before(o.bannedUntil) {
+		return time.Time{}, false
+	}
+	return o.bannedUntil, true
+}
+
+// reject records a rejected request from visitor id, and bans it once it
+// reaches the threshold.
+func (a *abuseDetector) reject(ctx context.Context, id, name string) {
+	if !a.enabled() {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	o, ok := a.offenders[id]
+	if !ok {
+		o = &offender{name: name, windowStart: now}
+		a.offenders[id] = o
+	}
+	if now.Sub(o.windowStart) > a.window {
+		o.rejections = 0
+		o.windowStart = now
+	}
+	o.rejections++
+	if o.rejections < a.threshold {
+		return
+	}
+	if !o.bannedUntil.IsZero() && now.Sub(o.bannedUntil) > a.maxBan {
+		// Behaved long enough to start over.
+		o.bans = 0
+	}
+	d := a.ban
+	for i := 0; i < o.bans && d < a.maxBan; i++ {
+		d *= 2
+	}
+	if d > a.maxBan {
+		d = a.maxBan
+	}
+	o.bans++
+	o.bannedUntil = now.Add(d)
+	o.rejections = 0
+	o.windowStart = now
+	gotils.L(ctx).Info().Printf("Banned visitor %s for %s, ban: %d", o.name, d, o.bans)
+}
+
+// banVisitor bans visitor id for d, regardless of the threshold.
+func (a *abuseDetector) banVisitor(ctx context.Context, id, name string, d time.Duration) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	o, ok := a.offenders[id]
+	if !ok {
+		o = &offender{name: name, windowStart: time.Now()}
+		a.offenders[id] = o
+	}
+	o.bans++
+	o.bannedUntil = time.Now().Add(d)
+	gotils.L(ctx).Info().Printf("Banned visitor %s for %s by admin", name, d)
+	return o.bannedUntil
+}
+
+// banInfo describes an active ban.
+type banInfo struct {
+	Visitor string    `json:"visitor"`
+	Until   time.Time `json:"until"`
+	Bans    int       `json:"bans"`
+}
+
+// list returns the active bans, ending soonest first.
+func (a *abuseDetector) list() []banInfo {
+	now := time.Now()
+	a.mu.Lock()
+	bans := []banInfo{}
+	for _, o := range a.offenders {
+		if now.Before(o.bannedUntil) {
+			bans = append(bans, banInfo{Visitor: o.name, Until: o.bannedUntil, Bans: o.bans})
+		}
+	}
+	a.mu.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// lift ends the ban of the visitor with name, and forgets its history. It
+// returns false if the visitor isn't banned.
+func (a *abuseDetector) lift(name string) bool {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, o := range a.offenders {
+		if o.name == name && now.Before(o.bannedUntil) {
+			delete(a.offenders, id)
+			return true
+		}
+	}
+	return false
+}
+
+// evictIdle forgets offenders which are neither banned, nor have recent
+// rejections or bans, and returns how many were removed.
+func (a *abuseDetector) evictIdle(now time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var n int
+	for id, o := range a.offenders {
+		if now.Sub(o.windowStart) > a.window && now.Sub(o.bannedUntil) > a.maxBan {
+			delete(a.offenders, id)
+			n++
+		}
+	}
+	return n
+}
+
+// janitor periodically evicts idle offenders until ctx is done.
+func (a *abuseDetector) janitor(ctx context.Context) {
+	t := time.NewTicker(a.window)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			a.evictIdle(now)
+		}
+	}
+}
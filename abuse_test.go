@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAbuseDetector(t *testing.T) {
+	a := newAbuseDetector(&ConfigData{BanThreshold: 3, BanDuration: time.Minute, MaxBanDuration: 3 * time.Minute})
+	ctx := context.Background()
+	ban := func() time.Duration {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			if _, ok := a.banned("v"); ok {
+				t.Fatalf("expected no ban before the threshold, rejection %d", i)
+			}
+			a.reject(ctx, "v", "visitor")
+		}
+		until, ok := a.banned("v")
+		if !ok {
+			t.Fatal("expected ban at the threshold")
+		}
+		// Serve the ban.
+		a.offenders["v"].bannedUntil = time.Now()
+		return time.Until(until).Round(time.Minute)
+	}
+	for i, exp := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if d := ban(); d != exp {
+			t.Errorf("ban %d: expected %s but got %s", i, exp, d)
+		}
+	}
+
+	a.reject(ctx, "v", "visitor")
+	a.reject(ctx, "v", "visitor")
+	a.reject(ctx, "v", "visitor")
+	if bans := a.list(); len(bans) != 1 || bans[0].Visitor != "visitor" {
+		t.Fatalf("expected one ban but got %v", bans)
+	}
+	if !a.lift("visitor") {
+		t.Fatal("expected ban to be lifted")
+	}
+	if _, ok := a.banned("v"); ok || a.lift("visitor") {
+		t.Error("expected no ban after lifting")
+	}
+}
+
+func TestAbuseDetector_server(t *testing.T) {
+	node := newFakeNode(t, map[string]interface{}{"eth_call": "0x1"})
+	s := testServer(t, ConfigData{URL: node.URL, Allow: []string{"eth_call"}, BanThreshold: 2})
+
+	for i := 0; i < 2; i++ {
+		if w := postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_sign","params":[]}`); w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("expected disallowed method to be rejected but got %d", w.Code)
+		}
+	}
+	w := postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)
+	var resp ErrResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusForbidden || resp.Error.Code != jsonRPCBanned {
+		t.Fatalf("expected banned response but got %d: %s", w.Code, w.Body)
+	}
+
+	admin := s.adminRouter("secret")
+	req := httptest.NewRequest(http.MethodGet, "/bans", nil)
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected admin API to require the token but got %d", rec.Code)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	var bans []banInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &bans); err != nil || len(bans) != 1 {
+		t.Fatalf("expected one ban but got %s", rec.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/bans?visitor="+bans[0].Visitor, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected ban to be lifted but got %d: %s", rec.Code, rec.Body)
+	}
+	if w := postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`); w.Code != http.StatusOK {
+		t.Errorf("expected request to be allowed after lifting the ban but got %d", w.Code)
+	}
+}
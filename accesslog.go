@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessLogHead is how much of a response is kept to find a JSON-RPC error.
+// Error responses are small, so larger responses aren't checked.
+const accessLogHead = 4096
+
+// accessLogEntry is a line of the access log.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	Transport string    `json:"transport"` // http or ws
+	IP        string    `json:"ip"`
+	APIKey    string    `json:"apiKey,omitempty"`
+	Methods   []string  `json:"methods"`
+	BatchSize int       `json:"batchSize,omitempty"`
+	Upstreams []string  `json:"upstreams,omitempty"` // Every upstream tried.
+	Status    int       `json:"status,omitempty"`
+	ErrorCode int       `json:"errorCode,omitempty"` // Of the first JSON-RPC error in the response.
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut,omitempty"`
+	LatencyMS float64   `json:"latencyMs,omitempty"`
+}
+
+// accessLog writes an accessLogEntry as a JSON line for every request. Only a
+// sample of successful requests are logged, but failures always are.
+type accessLog struct {
+	sample float64 // Fraction of successful requests which are logged.
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// newAccessLog returns an access log writing to stdout, stderr, or the file at
+// path, or nil if path is empty.
+func newAccessLog(path string, sample float64) (*accessLog, error) {
+	var w io.Writer
+	switch path {
+	case "":
+		return nil, nil
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log: %v", err)
+		}
+		w = f
+	}
+	if sample <= 0 || sample > 1 {
+		sample = 1
+	}
+	return &accessLog{sample: sample, enc: json.NewEncoder(w)}, nil
+}
+
+func (l *accessLog) log(e *accessLogEntry) {
+	if l == nil {
+		return
+	}
+	failed := e.Status >= 300 || e.ErrorCode != 0
+	if !failed && l.sample < 1 && rand.Float64() >= l.sample {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_ = l.enc.Encode(e)
+}
+
+// logBody logs e once body has been read and closed, with the response size,
+// error code and total latency since start.
+func (l *accessLog) logBody(body io.ReadCloser, e *accessLogEntry, start time.Time) io.ReadCloser {
+	if l == nil {
+		return body
+	}
+	return &loggedBody{ReadCloser: body, done: func(n int64, head []byte) {
+		e.BytesOut = n
+		if n <= int64(len(head)) {
+			e.ErrorCode = jsonRPCErrorCode(head)
+		}
+		e.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+		l.log(e)
+	}}
+}
+
+// loggedBody counts the bytes read from a response body, and keeps the first
+// accessLogHead of them.
+type loggedBody struct {
+	io.ReadCloser
+	n    int64
+	head bytes.Buffer
+	done func(n int64, head []byte)
+	once sync.Once
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if rem := accessLogHead - b.head.Len(); rem > 0 {
+		if rem > n {
+			rem = n
+		}
+		b.head.Write(p[:rem])
+	}
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n, b.head.Bytes()) })
+	return err
+}
+
+// jsonRPCErrorCode returns the code of the first error in a response, or 0.
+func jsonRPCErrorCode(body []byte) int {
+	if isBatch(body) {
+		var arr []ErrResponse
+		if err := json.Unmarshal(body, &arr); err != nil {
+			return 0
+		}
+		for _, r := range arr {
+			if r.Error.Code != 0 {
+				return r.Error.Code
+			}
+		}
+		return 0
+	}
+	var r ErrResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return 0
+	}
+	return r.Error.Code
+}
+
+// requestInfo collects details of a request which are only known deep in the
+// transport, like the upstreams it was sent to.
+type requestInfo struct {
+	mu        sync.Mutex
+	upstreams []string
+}
+
+func (i *requestInfo) addUpstream(up *upstream) {
+	i.addHost(up.url.Host)
+}
+
+func (i *requestInfo) addHost(host string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.upstreams = append(i.upstreams, host)
+	i.mu.Unlock()
+}
+
+func (i *requestInfo) getUpstreams() []string {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]string(nil), i.upstreams...)
+}
+
+func withRequestInfo(ctx context.Context, i *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoCtxKey, i)
+}
+
+// requestInfoFrom returns the requestInfo of ctx, or nil.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	i, _ := ctx.Value(requestInfoCtxKey).(*requestInfo)
+	return i
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readAccessLog(t *testing.T, path string) []accessLogEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []accessLogEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e accessLogEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("invalid access log line %q: %v", s.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	node := newFakeNode(t, map[string]interface{}{"eth_call": "0x1"})
+	path := filepath.Join(t.TempDir(), "access.log")
+	s := testServer(t, ConfigData{URL: node.URL, Allow: []string{"eth_call"}, AccessLog: path})
+
+	postRPC(s, `[{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]},{"jsonrpc":"2.0","id":2,"method":"eth_call","params":[]}]`)
+	postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_sign","params":[]}`)
+
+	entries := readAccessLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries but got %d", len(entries))
+	}
+	ok, blocked := entries[0], entries[1]
+	if ok.Transport != "http" || ok.IP != "192.0.2.1" || ok.BatchSize != 2 || ok.Status != http.StatusOK ||
+		len(ok.Upstreams) != 1 || ok.BytesIn == 0 || ok.BytesOut == 0 || ok.ErrorCode != 0 {
+		t.Errorf("unexpected entry for forwarded batch: %+v", ok)
+	}
+	if blocked.Status != http.StatusMethodNotAllowed || blocked.ErrorCode != jsonRPCUnavailable ||
+		len(blocked.Methods) != 1 || blocked.Methods[0] != "eth_sign" || len(blocked.Upstreams) != 0 {
+		t.Errorf("unexpected entry for blocked request: %+v", blocked)
+	}
+}
+
+func TestAccessLog_sample(t *testing.T) {
+	node := newFakeNode(t, map[string]interface{}{"eth_call": "0x1"})
+	path := filepath.Join(t.TempDir(), "access.log")
+	s := testServer(t, ConfigData{URL: node.URL, Allow: []string{"eth_call"}, AccessLog: path, AccessLogSample: 1e-9})
+
+	for i := 0; i < 10; i++ {
+		postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)
+	}
+	postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_sign","params":[]}`)
+
+	entries := readAccessLog(t, path)
+	if len(entries) != 1 || entries[0].Status != http.StatusMethodNotAllowed {
+		t.Errorf("expected only the failure to be logged but got %+v", entries)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/treeder/gotils/v2"
+)
+
+// adminRouter returns the handler of the admin API. When token is set, it must
+// be sent as a bearer token.
+func (p *Server) adminRouter(token string) http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(middleware.Recoverer)
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	r.Method(http.MethodGet, "/metrics", p.metrics.handler())
+	r.Get("/visitors", p.adminVisitors)
+	r.Get("/bans", p.adminBans)
+	r.Post("/bans", p.adminBan)
+	r.Delete("/bans", p.adminLiftBan)
+	r.Get("/nolimit", p.adminNoLimit)
+	r.Post("/nolimit", p.adminAddNoLimit)
+	r.Delete("/nolimit", p.adminRemoveNoLimit)
+	r.Get("/rpm", p.adminRPM)
+	r.Put("/rpm", p.adminSetRPM)
+	r.Get("/upstreams", p.adminUpstreams)
+	r.Get("/websockets", p.adminWebsockets)
+	return r
+}
+
+// readJSON decodes the request body into v, or writes an error and returns false.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		gotils.L(r.Context()).Error().Printf("Failed to write response: %v", err)
+	}
+}
+
+func (p *Server) adminBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, p.abuse.list())
+}
+
+// adminVisitors lists the visitors of the rate limiter, and their remaining tokens.
+func (p *Server) adminVisitors(w http.ResponseWriter, r *http.Request) {
+	m, ok := p.limiters.store.(*memoryStore)
+	if !ok {
+		http.Error(w, "visitors are only listed by the in-memory store", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, r, m.list())
+}
+
+// adminBan bans an IP, with a body like {"visitor": "1.2.3.4", "duration": "1h"}.
+// The duration defaults to MaxBanDuration.
+func (p *Server) adminBan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Visitor  string `json:"visitor"`
+		Duration string `json:"duration"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if net.ParseIP(req.Visitor) == nil {
+		http.Error(w, "visitor must be an IP", http.StatusBadRequest)
+		return
+	}
+	d := p.abuse.maxBan
+	if req.Duration != "" {
+		var err error
+		d, err = time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+	}
+	id := p.ipVisitorID(req.Visitor)
+	until := p.abuse.banVisitor(r.Context(), id, id, d)
+	writeJSON(w, r, banInfo{Visitor: id, Until: until})
+}
+
+// adminLiftBan lifts the ban of the visitor in the query, like
+// /bans?visitor=1.2.3.4. IPs may be given instead of their network.
+func (p *Server) adminLiftBan(w http.ResponseWriter, r *http.Request) {
+	visitor := r.URL.Query().Get("visitor")
+	if visitor == "" {
+		http.Error(w, "visitor is required", http.StatusBadRequest)
+		return
+	}
+	if !p.abuse.lift(visitor) && !p.abuse.lift(p.ipVisitorID(visitor)) {
+		http.Error(w, "visitor is not banned", http.StatusNotFound)
+		return
+	}
+	gotils.L(r.Context()).Info().Printf("Lifted ban of visitor %s", visitor)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Server) adminNoLimit(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, p.noLimitList())
+}
+
+// adminAddNoLimit exempts an IP or CIDR from rate limits, with a body like {"cidr": "10.0.0.0/8"}.
+func (p *Server) adminAddNoLimit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CIDR string `json:"cidr"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if err := p.addNoLimit(req.CIDR); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gotils.L(r.Context()).Info().Printf("Added %s to NoLimit", req.CIDR)
+	writeJSON(w, r, p.noLimitList())
+}
+
+// adminRemoveNoLimit removes the IP or CIDR in the query, like /nolimit?cidr=10.0.0.0/8
+func (p *Server) adminRemoveNoLimit(w http.ResponseWriter, r *http.Request) {
+	cidr := r.URL.Query().Get("cidr")
+	if !p.removeNoLimit(cidr) {
+		http.Error(w, "not in NoLimit", http.StatusNotFound)
+		return
+	}
+	gotils.L(r.Context()).Info().Printf("Removed %s from NoLimit", cidr)
+	writeJSON(w, r, p.noLimitList())
+}
+
+type rpmBody struct {
+	RPM int `json:"rpm"`
+}
+
+func (p *Server) adminRPM(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, rpmBody{RPM: p.getRPM()})
+}
+
+// adminSetRPM changes the rate limit of IPs, with a body like {"rpm": 1000}.
+func (p *Server) adminSetRPM(w http.ResponseWriter, r *http.Request) {
+	var req rpmBody
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.RPM <= 0 {
+		http.Error(w, "rpm must be positive", http.StatusBadRequest)
+		return
+	}
+	p.setRPM(req.RPM)
+	gotils.L(r.Context()).Info().Printf("Changed RPM to %d", req.RPM)
+	writeJSON(w, r, req)
+}
+
+// upstreamInfo describes the state of an upstream.
+type upstreamInfo struct {
+	Pool     string `json:"pool"`
+	URL      string `json:"url"`
+	Healthy  bool   `json:"healthy"`
+	Head     uint64 `json:"head"`
+	InFlight int64  `json:"inFlight"`
+	Circuit  string `json:"circuit"`
+	Weight   int    `json:"weight"`
+}
+
+func (p *Server) adminUpstreams(w http.ResponseWriter, r *http.Request) {
+	list := []upstreamInfo{}
+	for _, pool := range p.latestBlock.getPools() {
+		for _, u := range pool.list {
+			list = append(list, upstreamInfo{
+				Pool:     pool.name,
+				URL:      u.String(),
+				Healthy:  u.available(),
+				Head:     atomic.LoadUint64(&u.head),
+				InFlight: atomic.LoadInt64(&u.inFlight),
+				Circuit:  u.breaker.getState().String(),
+				Weight:   u.weight,
+			})
+		}
+	}
+	writeJSON(w, r, list)
+}
+
+func (p *Server) adminWebsockets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, p.wsProxy.sessions.list())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminDo(t *testing.T, s *Server, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	s.adminRouter("secret").ServeHTTP(w, req)
+	return w
+}
+
+func TestAdmin(t *testing.T) {
+	node := newFakeNode(t, map[string]interface{}{"eth_call": "0x1"})
+	s := testServer(t, ConfigData{URL: node.URL, Allow: []string{"eth_call"}})
+	const call = `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`
+
+	if w := postRPC(s, call); w.Code != http.StatusOK {
+		t.Fatalf("expected request to be allowed but got %d", w.Code)
+	}
+	var visitors []visitorInfo
+	w := adminDo(t, s, http.MethodGet, "/visitors", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &visitors); err != nil || len(visitors) != 1 || visitors[0].Visitor != "192.0.2.1" {
+		t.Fatalf("expected one visitor but got %s", w.Body)
+	}
+	// API keys are not revealed.
+	s.limiters.AllowVisitor(context.Background(), ModifiedRequest{Key: &apiKey{key: "secret-key"}}, 1)
+	if w := adminDo(t, s, http.MethodGet, "/visitors", ""); strings.Contains(w.Body.String(), "secret-key") {
+		t.Errorf("expected visitors without the api key but got %s", w.Body)
+	}
+
+	if w := adminDo(t, s, http.MethodPost, "/bans", `{"visitor":"192.0.2.1","duration":"1h"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected ban but got %d: %s", w.Code, w.Body)
+	}
+	if w := postRPC(s, call); w.Code != http.StatusForbidden {
+		t.Errorf("expected banned IP to be refused but got %d", w.Code)
+	}
+	if w := adminDo(t, s, http.MethodDelete, "/bans?visitor=192.0.2.1", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected ban to be lifted but got %d: %s", w.Code, w.Body)
+	}
+	if w := adminDo(t, s, http.MethodPost, "/bans", `{"visitor":"nope"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid IP to be refused but got %d", w.Code)
+	}
+
+	if w := adminDo(t, s, http.MethodPut, "/rpm", `{"rpm":20}`); w.Code != http.StatusOK {
+		t.Fatalf("expected rpm to be changed but got %d: %s", w.Code, w.Body)
+	}
+	if s.getRPM() != 20 {
+		t.Errorf("expected rpm 20 but got %d", s.getRPM())
+	}
+	var limited bool
+	for i := 0; i < 5 && !limited; i++ {
+		limited = postRPC(s, call).Code == http.StatusTooManyRequests
+	}
+	if !limited {
+		t.Error("expected lower rpm to limit requests")
+	}
+
+	if w := adminDo(t, s, http.MethodPost, "/nolimit", `{"cidr":"192.0.2.0/24"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected nolimit entry to be added but got %d: %s", w.Code, w.Body)
+	}
+	if w := postRPC(s, call); w.Code != http.StatusOK {
+		t.Errorf("expected exempt IP to be allowed but got %d", w.Code)
+	}
+	if w := adminDo(t, s, http.MethodDelete, "/nolimit?cidr=192.0.2.0/24", ""); w.Code != http.StatusOK {
+		t.Errorf("expected nolimit entry to be removed but got %d: %s", w.Code, w.Body)
+	}
+	if w := adminDo(t, s, http.MethodDelete, "/nolimit?cidr=192.0.2.0/24", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected missing nolimit entry to be not found but got %d", w.Code)
+	}
+
+	var ups []upstreamInfo
+	w = adminDo(t, s, http.MethodGet, "/upstreams", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &ups); err != nil || len(ups) != 1 || !ups[0].Healthy {
+		t.Fatalf("expected one healthy upstream but got %s", w.Body)
+	}
+
+	w = adminDo(t, s, http.MethodGet, "/websockets", "")
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("expected no websocket sessions but got %s", w.Body)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	toml "github.com/pelletier/go-toml"
+)
+
+const apiKeyHeader = "X-API-Key"
+const apiKeyQuery = "apikey"
+
+// KeyConfig is an API key and the policy applied to requests using it.
+type KeyConfig struct {
+	Key     string   `toml:",omitempty"`
+	Name    string   `toml:",omitempty"` // Used in logs instead of the key.
+	RPM     int      `toml:",omitempty"` // 0 means the global RPM.
+	NoLimit bool     `toml:",omitempty"` // Exempt from rate limiting.
+	Allow   []string `toml:",omitempty"` // Allowed methods. Empty means the global Allow list.
+	Origins []string `toml:",omitempty"` // Allowed Origin headers. Empty means any.
+	IPs     []string `toml:",omitempty"` // Allowed client IPs. Empty means any.
+}
+
+// keyFile is the format of the KeyFile.
+type keyFile struct {
+	Keys []KeyConfig `toml:",omitempty"`
+}
+
+type apiKey struct {
+	key, name string
+	rpm       int
+	noLimit   bool
+	matcher   matcher // nil means the global Allow list.
+	origins   map[string]struct{}
+	ips       map[string]struct{}
+}
+
+// visitorID returns the rate limiter id for requests using k. It is a hash of
+// the key, since ids are listed by the admin API and stored in Redis.
+func (k *apiKey) visitorID() string {
+	sum := sha256.Sum256([]byte(k.key))
+	return "key:" + hex.EncodeToString(sum[:16])
+}
+
+// apiKeys are API keys by key.
+type apiKeys map[string]*apiKey
+
+func newAPIKeys(cfgs []KeyConfig, path string) (apiKeys, error) {
+	if path != "" {
+		t, err := toml.LoadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key file: %v", err)
+		}
+		var kf keyFile
+		if err := t.Unmarshal(&kf); err != nil {
+			return nil, fmt.Errorf("failed to parse key file: %v", err)
+		}
+		cfgs = append(cfgs[:len(cfgs):len(cfgs)], kf.Keys...)
+	}
+	keys := make(apiKeys, len(cfgs))
+	for _, c := range cfgs {
+		if c.Key == "" {
+			return nil, errors.New("api key is required")
+		}
+		k := &apiKey{key: c.Key, name: c.Name, rpm: c.RPM, noLimit: c.NoLimit}
+		if k.name == "" {
+			// Enough to tell keys apart in logs, without revealing them.
+			k.name = c.Key
+			if len(k.name) > 4 {
+				k.name = k.name[:4] + "..."
+			}
+		}
+		if _, ok := keys[c.Key]; ok {
+			return nil, fmt.Errorf("duplicate api key: %s", k.name)
+		}
+		if len(c.Allow) > 0 {
+			m, err := newMatcher(c.Allow)
+			if err != nil {
+				return nil, err
+			}
+			k.matcher = m
+		}
+		if len(c.Origins) > 0 {
+			k.origins = make(map[string]struct{})
+			for _, o := range c.Origins {
+				k.origins[o] = struct{}{}
+			}
+		}
+		if len(c.IPs) > 0 {
+			k.ips = make(map[string]struct{})
+			for _, ip := range c.IPs {
+				k.ips[ip] = struct{}{}
+			}
+		}
+		keys[c.Key] = k
+	}
+	return keys, nil
+}
+
+type ctxKey int
+
+const (
+	apiKeyCtxKey ctxKey = iota
+	requestInfoCtxKey
+)
+
+func withAPIKey(ctx context.Context, k *apiKey) context.Context {
+	return context.WithValue(ctx, apiKeyCtxKey, k)
+}
+
+// apiKeyFrom returns the API key of the request, or nil.
+func apiKeyFrom(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyCtxKey).(*apiKey)
+	return k
+}
+
+// authenticate looks up the API key of r, from the /v1/{key} path, header, or
+// query. ip is the client IP of r. It returns r with the key removed and attached to the context, or a
+// status code and error if the key is invalid or not permitted. Requests
+// without a key are returned unchanged.
+func (keys apiKeys) authenticate(r *http.Request, ip string) (*http.Request, int, error) {
+	key := chi.URLParam(r, "key")
+	fromPath := key != ""
+	if key == "" {
+		key = r.Header.Get(apiKeyHeader)
+	}
+	if key == "" {
+		key = r.URL.Query().Get(apiKeyQuery)
+	}
+	if key == "" {
+		return r, 0, nil
+	}
+	k, ok := keys[key]
+	if !ok {
+		return nil, http.StatusUnauthorized, errors.New("Invalid API key")
+	}
+	if k.origins != nil {
+		if _, ok := k.origins[r.Header.Get("Origin")]; !ok {
+			return nil, http.StatusForbidden, errors.New("Origin not allowed for API key")
+		}
+	}
+	if k.ips != nil {
+		if _, ok := k.ips[ip]; !ok {
+			return nil, http.StatusForbidden, errors.New("IP not allowed for API key")
+		}
+	}
+
+	// Don't leak the key to the upstream.
+	r = r.WithContext(withAPIKey(r.Context(), k))
+	r.Header = r.Header.Clone()
+	r.Header.Del(apiKeyHeader)
+	u := *r.URL
+	if fromPath {
+		u.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, "/v1/"+key), "/")
+		u.RawPath = ""
+	}
+	if q := u.Query(); q.Get(apiKeyQuery) != "" {
+		q.Del(apiKeyQuery)
+		u.RawQuery = q.Encode()
+	}
+	r.URL = &u
+	return r, 0, nil
+}
+
+// setKey sets the API key of every request.
+func setKey(reqs []ModifiedRequest, k *apiKey) {
+	for i := range reqs {
+		reqs[i].Key = k
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAPIKeys_authenticate(t *testing.T) {
+	keys, err := newAPIKeys([]KeyConfig{
+		{Key: "open"},
+		{Key: "locked", Origins: []string{"https://example.com"}, IPs: []string{"10.0.0.1"}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *http.Request
+	r := chi.NewRouter()
+	r.HandleFunc("/*", func(w http.ResponseWriter, r *http.Request) {})
+	r.HandleFunc("/v1/{key}", func(w http.ResponseWriter, r *http.Request) {
+		var code int
+		got, code, err = keys.authenticate(r, r.Header.Get("X-Test-IP"))
+		if err != nil {
+			w.WriteHeader(code)
+		}
+	})
+	r.HandleFunc("/v1/{key}/ws", func(w http.ResponseWriter, r *http.Request) {
+		got, _, err = keys.authenticate(r, r.Header.Get("X-Test-IP"))
+	})
+
+	for _, test := range []struct {
+		name   string
+		path   string
+		header http.Header
+		code   int
+		want   string // Path and query forwarded upstream.
+	}{
+		{name: "path", path: "/v1/open", want: "/"},
+		{name: "path-ws", path: "/v1/open/ws", want: "/ws"},
+		{name: "unknown", path: "/v1/nope", code: http.StatusUnauthorized},
+		{name: "origin", path: "/v1/locked", header: http.Header{"Origin": {"https://example.com"}, "X-Test-IP": {"10.0.0.1"}}, want: "/"},
+		{name: "wrong-origin", path: "/v1/locked", header: http.Header{"Origin": {"https://evil.com"}, "X-Test-IP": {"10.0.0.1"}}, code: http.StatusForbidden},
+		{name: "wrong-ip", path: "/v1/locked", header: http.Header{"Origin": {"https://example.com"}}, code: http.StatusForbidden},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err = nil, nil
+			req := httptest.NewRequest(http.MethodPost, test.path, nil)
+			for k, v := range test.header {
+				req.Header[http.CanonicalHeaderKey(k)] = v
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if test.code != 0 {
+				if w.Code != test.code {
+					t.Errorf("expected status %d but got %d", test.code, w.Code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.URL.RequestURI() != test.want {
+				t.Errorf("expected %q but got %q", test.want, got.URL.RequestURI())
+			}
+			if apiKeyFrom(got.Context()) == nil {
+				t.Error("expected api key in context")
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/?apikey=open&x=1", nil)
+	req.Header.Set(apiKeyHeader, "open")
+	got, _, err = keys.authenticate(req, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.RequestURI() != "/?x=1" || got.Header.Get(apiKeyHeader) != "" {
+		t.Errorf("expected key to be removed but got %q %q", got.URL.RequestURI(), got.Header.Get(apiKeyHeader))
+	}
+}
+
+func TestAPIKeys_policy(t *testing.T) {
+	node := newFakeNode(t, map[string]interface{}{"eth_call": "0x1", "eth_getBalance": "0x2"})
+	s := testServer(t, ConfigData{
+		URL:   node.URL,
+		Allow: []string{"eth_call"},
+		Keys: []KeyConfig{
+			{Key: "partner", RPM: 100000, Allow: []string{"eth_call", "eth_getBalance"}},
+			{Key: "small", RPM: 100},
+		},
+	})
+	post := func(key, method string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":[]}`))
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		s.RPCProxy(w, req)
+		return w.Code
+	}
+
+	if code := post("", "eth_getBalance"); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected method to be blocked without key but got %d", code)
+	}
+	if code := post("partner", "eth_getBalance"); code != http.StatusOK {
+		t.Errorf("expected method to be allowed with key but got %d", code)
+	}
+	if code := post("bad", "eth_call"); code != http.StatusUnauthorized {
+		t.Errorf("expected invalid key to be rejected but got %d", code)
+	}
+
+	// The small key has a burst of 10, and is limited separately from the IP.
+	var limited int
+	for i := 0; i < 20; i++ {
+		if post("small", "eth_call") == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited == 0 {
+		t.Error("expected small key to be rate limited")
+	}
+	if code := post("", "eth_call"); code != http.StatusOK {
+		t.Errorf("expected IP to have its own limit but got %d", code)
+	}
+	if code := post("partner", "eth_call"); code != http.StatusOK {
+		t.Errorf("expected partner key to have its own limit but got %d", code)
+	}
+}
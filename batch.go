@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/treeder/gotils/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// batchChunk is part of a batch which is sent to a single pool.
+type batchChunk struct {
+	pool    *upstreams
+	indexes []int // Positions of the elements in the original batch.
+}
+
+// forwardBatch splits a batch by pool, and into chunks of at most
+// maxUpstreamBatch, sends the chunks concurrently, and reassembles the
+// responses in the original order. Elements which already have a response
+// are not forwarded. The response has status httpCode if nothing was
+// forwarded, otherwise 200.
+func (t *myTransport) forwardBatch(ctx context.Context, req *http.Request, parsedRequests []ModifiedRequest, responses []json.RawMessage, httpCode int) (*http.Response, error) {
+	maxBatch := t.settings().maxUpstreamBatch
+	var chunks []*batchChunk
+	open := map[*upstreams]*batchChunk{}
+	for i, r := range parsedRequests {
+		if responses[i] != nil {
+			continue
+		}
+		pool := t.route(ctx, r)
+		c := open[pool]
+		if c == nil || (maxBatch > 0 && len(c.indexes) >= maxBatch) {
+			c = &batchChunk{pool: pool}
+			open[pool] = c
+			chunks = append(chunks, c)
+		}
+		c.indexes = append(c.indexes, i)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range chunks {
+		wg.Add(1)
+		go func(c *batchChunk) {
+			defer wg.Done()
+			elems := make([]ModifiedRequest, len(c.indexes))
+			for j, i := range c.indexes {
+				elems[j] = parsedRequests[i]
+			}
+			results := t.forwardChunk(ctx, req, c.pool, elems)
+			for j, i := range c.indexes {
+				responses[i] = t.raiseHead(elems[j], results[j])
+				if results[j] != nil {
+					t.toCache(ctx, elems[j], results[j])
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if len(chunks) > 0 {
+		httpCode = http.StatusOK
+	}
+	return batchResponse(httpCode, responses)
+}
+
+// hasMethod returns true if any of reqs is for method.
+func hasMethod(reqs []ModifiedRequest, method string) bool {
+	for _, r := range reqs {
+		if r.Path == method {
+			return true
+		}
+	}
+	return false
+}
+
+func anyBlocked(resps []interface{}) bool {
+	for _, r := range resps {
+		if r != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedCode returns the HTTP status code shared by every blocked element, or
+// 200 if they differ or some are allowed.
+func blockedCode(codes []int) int {
+	code := codes[0]
+	for _, c := range codes[1:] {
+		if c != code {
+			return http.StatusOK
+		}
+	}
+	if code == 0 {
+		return http.StatusOK
+	}
+	return code
+}
+
+// forwardChunk sends elems as a single batch to pool, and returns the response
+// for each element, in order. Notifications have no response.
+func (t *myTransport) forwardChunk(ctx context.Context, req *http.Request, pool *upstreams, elems []ModifiedRequest) []json.RawMessage {
+	ctx, span := tracer().Start(ctx, "batch.chunk", trace.WithAttributes(attribute.String("pool", pool.name), attribute.Int("rpc.batch_size", len(elems))))
+	defer span.End()
+	var body bytes.Buffer
+	body.WriteByte('[')
+	for i, e := range elems {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(e.Raw)
+	}
+	body.WriteByte(']')
+
+	sub := req.Clone(ctx)
+	// Let the transport decompress, so the responses can be split.
+	sub.Header.Del("Accept-Encoding")
+	setBody(sub, body.Bytes())
+	sub.ContentLength = int64(body.Len())
+
+	results, err := t.doChunk(ctx, sub, pool, elems)
+	if err != nil {
+		gotils.L(ctx).Error().Printf("Failed to forward batch to pool %s: %v", pool.name, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		results = make([]json.RawMessage, len(elems))
+		for i, e := range elems {
+			if len(e.ID) > 0 {
+				results[i] = mustMarshal(jsonRPCError(e.ID, jsonRPCInternal, err.Error()))
+			}
+		}
+	}
+	return results
+}
+
+func (t *myTransport) doChunk(ctx context.Context, req *http.Request, pool *upstreams, elems []ModifiedRequest) ([]json.RawMessage, error) {
+	resp, err := t.forward(ctx, req, pool, t.retryable(elems))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream response: %v", err)
+	}
+
+	if !isBatch(body) {
+		// A single error for the whole batch applies to every element.
+		var errResp ErrResponse
+		if err := json.Unmarshal(body, &errResp); err != nil || errResp.Error.Message == "" {
+			return nil, fmt.Errorf("invalid upstream response: status %d", resp.StatusCode)
+		}
+		results := make([]json.RawMessage, len(elems))
+		for i, e := range elems {
+			if len(e.ID) > 0 {
+				results[i] = mustMarshal(jsonRPCError(e.ID, errResp.Error.Code, errResp.Error.Message))
+			}
+		}
+		return results, nil
+	}
+
+	var arr []json.RawMessage
+	if err := json.Unmarshal(body, &arr); err != nil {
+		return nil, fmt.Errorf("failed to parse upstream response: %v", err)
+	}
+	// Responses may come back in any order, so match them up by id.
+	byID := map[string][]json.RawMessage{}
+	for _, r := range arr {
+		var withID struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(r, &withID); err != nil {
+			return nil, fmt.Errorf("failed to parse upstream response: %v", err)
+		}
+		k := idKey(withID.ID)
+		byID[k] = append(byID[k], r)
+	}
+	results := make([]json.RawMessage, len(elems))
+	for i, e := range elems {
+		if len(e.ID) == 0 {
+			continue
+		}
+		k := idKey(e.ID)
+		if rs := byID[k]; len(rs) > 0 {
+			results[i] = rs[0]
+			byID[k] = rs[1:]
+		} else {
+			results[i] = mustMarshal(jsonRPCError(e.ID, jsonRPCInternal, "Missing response from upstream"))
+		}
+	}
+	return results, nil
+}
+
+// idKey returns a comparable form of a JSON-RPC id.
+func idKey(id json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, id); err != nil {
+		return string(id)
+	}
+	return buf.String()
+}
+
+// batchResponse returns the non-nil responses as a JSON array.
+func batchResponse(httpCode int, responses []json.RawMessage) (*http.Response, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	n := 0
+	for _, r := range responses {
+		if r == nil {
+			continue
+		}
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(r)
+		n++
+	}
+	buf.WriteByte(']')
+	if n == 0 {
+		// Only notifications, so nothing to respond with.
+		buf.Reset()
+	}
+	return &http.Response{
+		Body:          ioutil.NopCloser(&buf),
+		ContentLength: int64(buf.Len()),
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		StatusCode:    httpCode,
+	}, nil
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
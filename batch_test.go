@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForwardBatch(t *testing.T) {
+	full := newFakeNode(t, nodeResults("0x10"))
+	full.set("eth_chainId", "0x3c")
+	archive := newFakeNode(t, nodeResults("0x10"))
+	archive.set("debug_traceTransaction", "trace")
+	s := testServer(t, ConfigData{
+		Upstreams:        []UpstreamConfig{{URL: full.URL}},
+		Pools:            []PoolConfig{{Name: "archive", Upstreams: []UpstreamConfig{{URL: archive.URL}}}},
+		Routes:           []RouteConfig{{Methods: []string{"^debug_"}, Pool: "archive"}},
+		Allow:            []string{"eth_chainId", "debug_traceTransaction"},
+		MaxUpstreamBatch: 2,
+	})
+
+	w := postRPC(s, `[
+		{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":"a","method":"debug_traceTransaction","params":["0x00"]},
+		{"jsonrpc":"2.0","method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":3,"method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":4,"method":"eth_chainId"}
+	]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	var resps []struct {
+		ID     json.RawMessage `json:"id"`
+		Result string          `json:"result"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil {
+		t.Fatalf("failed to parse response %s: %v", w.Body, err)
+	}
+	want := []struct{ id, result string }{{"1", "0x3c"}, {`"a"`, "trace"}, {"3", "0x3c"}, {"4", "0x3c"}}
+	if len(resps) != len(want) {
+		t.Fatalf("expected %d responses but got: %s", len(want), w.Body)
+	}
+	for i, w := range want {
+		if string(resps[i].ID) != w.id || resps[i].Result != w.result {
+			t.Errorf("response %d: want id %s result %s but got id %s result %s", i, w.id, w.result, resps[i].ID, resps[i].Result)
+		}
+	}
+	if n := archive.called("debug_traceTransaction"); n != 1 {
+		t.Errorf("expected 1 call to archive but got %d", n)
+	}
+	if n := full.called("eth_chainId"); n != 4 {
+		t.Errorf("expected 4 calls to full node but got %d", n)
+	}
+}
+
+func TestForwardBatch_gzip(t *testing.T) {
+	node := newFakeNode(t, nodeResults("0x10"))
+	node.set("eth_chainId", "0x3c")
+	node.compress()
+	s := testServer(t, ConfigData{URL: node.URL, Allow: []string{"eth_chainId"}, MaxUpstreamBatch: 1})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[
+		{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}
+	]`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.RPCProxy(w, req)
+	var resps []resultResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil || len(resps) != 2 {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body)
+	}
+	for _, resp := range resps {
+		if string(resp.Result) != `"0x3c"` {
+			t.Errorf("expected result from a gzipped upstream response but got %s", w.Body)
+		}
+	}
+}
+
+func TestForwardBatch_blocked(t *testing.T) {
+	node := newFakeNode(t, nodeResults("0x10"))
+	node.set("eth_chainId", "0x3c")
+	s := testServer(t, ConfigData{
+		Upstreams: []UpstreamConfig{{URL: node.URL}},
+		Allow:     []string{"eth_chainId"},
+	})
+
+	w := postRPC(s, `[
+		{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},
+		{"jsonrpc":"2.0","id":2,"method":"admin_peers"},
+		{"jsonrpc":"2.0","id":3,"method":"eth_chainId"}
+	]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	var resps []ErrResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil {
+		t.Fatalf("failed to parse response %s: %v", w.Body, err)
+	}
+	if len(resps) != 3 {
+		t.Fatalf("expected 3 responses but got: %s", w.Body)
+	}
+	for i, id := range []string{"1", "2", "3"} {
+		if string(resps[i].ID) != id {
+			t.Errorf("response %d: expected id %s but got %s", i, id, resps[i].ID)
+		}
+	}
+	if resps[1].Error.Code != jsonRPCUnavailable || resps[0].Error.Code != 0 || resps[2].Error.Code != 0 {
+		t.Errorf("expected only the second element to be rejected: %s", w.Body)
+	}
+	if n := node.called("eth_chainId"); n != 2 {
+		t.Errorf("expected 2 forwarded calls but got %d", n)
+	}
+
+	// A batch with only rejected elements keeps the status code.
+	w = postRPC(s, `[{"jsonrpc":"2.0","id":1,"method":"admin_peers"}]`)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d but got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil || len(resps) != 1 {
+		t.Errorf("expected a batch response but got: %s", w.Body)
+	}
+}
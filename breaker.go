@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerWindow   = time.Minute
+	defaultBreakerCooldown = 30 * time.Second
+
+	// breakerMinRequests is the minimum number of requests in a window before
+	// the error rate is considered.
+	breakerMinRequests = 10
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is a circuit breaker for a single upstream. It opens after too many
+// consecutive failures or too high an error rate, then after a cooldown lets a
+// single probe request through and closes again if it succeeds.
+type breaker struct {
+	failures  int     // Consecutive failures to open. 0 disables.
+	errorRate float64 // Error rate within window to open. 0 disables.
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu sync.Mutex // Protects everything below.
+
+	state       breakerState
+	consecutive int
+	requests    int
+	errors      int
+	windowStart time.Time
+	changedAt   time.Time // When state last changed, or the last probe was let through.
+}
+
+func newBreaker(cfg *ConfigData) *breaker {
+	b := &breaker{
+		failures:  cfg.BreakerFailures,
+		errorRate: cfg.BreakerErrorRate,
+		window:    cfg.BreakerWindow,
+		cooldown:  cfg.BreakerCooldown,
+	}
+	if b.failures == 0 {
+		b.failures = defaultBreakerFailures
+	} else if b.failures < 0 {
+		b.failures = 0
+	}
+	if b.window <= 0 {
+		b.window = defaultBreakerWindow
+	}
+	if b.cooldown <= 0 {
+		b.cooldown = defaultBreakerCooldown
+	}
+	return b
+}
+
+func (b *breaker) enabled() bool {
+	return b != nil && (b.failures > 0 || b.errorRate > 0)
+}
+
+// ready reports whether a request would currently be allowed, without
+// reserving the half-open probe.
+func (b *breaker) ready() bool {
+	if !b.enabled() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerClosed || time.Since(b.changedAt) >= b.cooldown
+}
+
+// allow reports whether a request may be sent, and reserves the probe when
+// half-open. An unreported probe expires after the cooldown.
+func (b *breaker) allow() bool {
+	if !b.enabled() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerClosed {
+		return true
+	}
+	if time.Since(b.changedAt) < b.cooldown {
+		return false
+	}
+	b.state = breakerHalfOpen
+	b.changedAt = time.Now()
+	return true
+}
+
+// record reports the result of a request and returns the new state if it changed.
+func (b *breaker) record(success bool) (breakerState, bool) {
+	if !b.enabled() {
+		return breakerClosed, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.windowStart) > b.window {
+		b.windowStart = now
+		b.requests, b.errors = 0, 0
+	}
+	b.requests++
+	if success {
+		b.consecutive = 0
+		if b.state != breakerClosed {
+			b.reset(now)
+			return b.state, true
+		}
+		return b.state, false
+	}
+	b.errors++
+	b.consecutive++
+	switch b.state {
+	case breakerHalfOpen:
+		// The probe failed, so wait for another cooldown.
+		b.state = breakerOpen
+		b.changedAt = now
+		return b.state, true
+	case breakerClosed:
+		if (b.failures > 0 && b.consecutive >= b.failures) ||
+			(b.errorRate > 0 && b.requests >= breakerMinRequests && float64(b.errors)/float64(b.requests) >= b.errorRate) {
+			b.state = breakerOpen
+			b.changedAt = now
+			return b.state, true
+		}
+	}
+	return b.state, false
+}
+
+func (b *breaker) reset(now time.Time) {
+	b.state = breakerClosed
+	b.changedAt = now
+	b.consecutive = 0
+	b.windowStart = now
+	b.requests, b.errors = 0, 0
+}
+
+func (b *breaker) getState() breakerState {
+	if !b.enabled() {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(&ConfigData{BreakerFailures: 3, BreakerCooldown: 20 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		b.record(false)
+	}
+	if !b.allow() {
+		t.Fatal("expected closed circuit to allow requests")
+	}
+	if state, changed := b.record(false); !changed || state != breakerOpen {
+		t.Fatalf("expected circuit to open but got %s", state)
+	}
+	if b.ready() || b.allow() {
+		t.Fatal("expected open circuit to reject requests")
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	if b.getState() != breakerHalfOpen {
+		t.Fatalf("expected half-open but got %s", b.getState())
+	}
+	if b.allow() {
+		t.Fatal("expected only a single probe")
+	}
+	if state, _ := b.record(false); state != breakerOpen {
+		t.Fatalf("expected failed probe to re-open but got %s", state)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	if state, changed := b.record(true); !changed || state != breakerClosed {
+		t.Fatalf("expected successful probe to close but got %s", state)
+	}
+}
+
+func TestBreaker_errorRate(t *testing.T) {
+	b := newBreaker(&ConfigData{BreakerFailures: -1, BreakerErrorRate: 0.5})
+	for i := 0; i < breakerMinRequests-1; i++ {
+		b.record(i%2 == 0)
+	}
+	if b.getState() != breakerClosed {
+		t.Fatal("expected closed circuit below the minimum requests")
+	}
+	b.record(false)
+	if b.getState() != breakerOpen {
+		t.Fatalf("expected open circuit but got %s", b.getState())
+	}
+}
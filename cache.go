@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/gochain/gochain/v3/rpc"
+)
+
+// defaultCacheBlocksBehind is how far below the head a block must be before
+// results for it are cached, so they aren't changed by a reorg.
+const defaultCacheBlocksBehind = 64
+
+// cacheRule describes when the result of a method can't change.
+type cacheRule int
+
+const (
+	cacheAlways  cacheRule = iota + 1 // Fixed for the chain.
+	cacheByHash                       // Looked up by block hash.
+	cacheByBlock                      // Requested at a block number far enough behind the head.
+	cacheMined                        // Describes a transaction in a block far enough behind the head.
+)
+
+// cacheRules are the methods which can be cached, besides those with a block
+// number parameter, which are cached by block.
+var cacheRules = map[string]cacheRule{
+	"eth_chainId":                           cacheAlways,
+	"net_version":                           cacheAlways,
+	"eth_getBlockByHash":                    cacheByHash,
+	"eth_getBlockTransactionCountByHash":    cacheByHash,
+	"eth_getTransactionByBlockHashAndIndex": cacheByHash,
+	"eth_getTransactionByHash":              cacheMined,
+	"eth_getTransactionReceipt":             cacheMined,
+}
+
+func cacheRuleFor(method string) cacheRule {
+	if rule, ok := cacheRules[method]; ok {
+		return rule
+	}
+	if _, ok := blockParamIndex[method]; ok {
+		return cacheByBlock
+	}
+	return 0
+}
+
+// responseCache holds the results of requests which can't change, and evicts
+// the least recently used once it holds more than maxBytes.
+type responseCache struct {
+	maxBytes     int64
+	blocksBehind uint64
+
+	mu    sync.Mutex
+	bytes int64
+	lru   *list.List // Of *cacheEntry, most recently used first.
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key    string
+	result json.RawMessage
+	block  uint64 // The block the result depends on, or 0 for none.
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.result))
+}
+
+// newResponseCache returns a cache of maxBytes, or nil if maxBytes is 0.
+func newResponseCache(maxBytes int64, blocksBehind uint64) *responseCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	if blocksBehind == 0 {
+		blocksBehind = defaultCacheBlocksBehind
+	}
+	return &responseCache{
+		maxBytes:     maxBytes,
+		blocksBehind: blocksBehind,
+		lru:          list.New(),
+		items:        make(map[string]*list.Element),
+	}
+}
+
+func (c *responseCache) get(key string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).result, true
+}
+
+func (c *responseCache) add(key string, result json.RawMessage, block uint64) {
+	e := &cacheEntry{key: key, result: result, block: block}
+	if e.size() > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.lru.PushFront(e)
+	c.bytes += e.size()
+	for c.bytes > c.maxBytes {
+		el := c.lru.Back()
+		old := el.Value.(*cacheEntry)
+		c.lru.Remove(el)
+		delete(c.items, old.key)
+		c.bytes -= old.size()
+	}
+}
+
+// invalidate removes the results which depend on blocks from fork on, and
+// returns how many there were.
+func (c *responseCache) invalidate(fork uint64) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*cacheEntry); e.block != 0 && e.block >= fork {
+			c.lru.Remove(el)
+			delete(c.items, e.key)
+			c.bytes -= e.size()
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// size returns the bytes held.
+func (c *responseCache) size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// cacheKey identifies a request by its method and parameters.
+func cacheKey(r ModifiedRequest) string {
+	var buf bytes.Buffer
+	buf.WriteString(r.Path)
+	for _, p := range r.Params {
+		buf.WriteByte(0)
+		if err := json.Compact(&buf, p); err != nil {
+			buf.Write(p)
+		}
+	}
+	return buf.String()
+}
+
+// settled returns true if block num is far enough behind the head to be cached.
+func (t *myTransport) settled(ctx context.Context, num uint64) bool {
+	head, err := t.latestBlock.get(ctx)
+	return err == nil && num+t.cache.blocksBehind <= head
+}
+
+// cacheable returns the cache key of r and the block its result depends on,
+// or false if its result may change. The result of cacheMined methods must be
+// checked as well.
+func (t *myTransport) cacheable(ctx context.Context, r ModifiedRequest) (string, uint64, bool) {
+	if len(r.ID) == 0 {
+		return "", 0, false
+	}
+	var block uint64
+	switch cacheRuleFor(r.Path) {
+	case cacheAlways, cacheByHash, cacheMined:
+	case cacheByBlock:
+		num, ok := blockParam(r)
+		if !ok || !t.settled(ctx, num) {
+			return "", 0, false
+		}
+		block = num
+	default:
+		return "", 0, false
+	}
+	return cacheKey(r), block, true
+}
+
+// fromCache fills in the responses of requests which are cached, and returns
+// how many were. Requests which already have a response are skipped.
+func (t *myTransport) fromCache(ctx context.Context, parsedRequests []ModifiedRequest, responses []json.RawMessage) int {
+	if t.cache == nil {
+		return 0
+	}
+	var hits int
+	for i, r := range parsedRequests {
+		if responses[i] != nil {
+			continue
+		}
+		key, _, ok := t.cacheable(ctx, r)
+		if !ok {
+			continue
+		}
+		result, ok := t.cache.get(key)
+		t.metrics.cacheLookup(ok)
+		if ok {
+			responses[i] = mustMarshal(jsonRPCResult(r.ID, result))
+			hits++
+		}
+	}
+	return hits
+}
+
+// toCache caches the result in response to r, if it can't change.
+func (t *myTransport) toCache(ctx context.Context, r ModifiedRequest, response json.RawMessage) {
+	if t.cache == nil {
+		return
+	}
+	key, block, ok := t.cacheable(ctx, r)
+	if !ok {
+		return
+	}
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(response, &resp); err != nil || len(resp.Error) > 0 {
+		return
+	}
+	// A null result, like an unknown hash, may be found later.
+	if len(resp.Result) == 0 || bytes.Equal(resp.Result, []byte("null")) {
+		return
+	}
+	if cacheRuleFor(r.Path) == cacheMined {
+		var tx struct {
+			BlockNumber *rpc.BlockNumber `json:"blockNumber"`
+		}
+		if err := json.Unmarshal(resp.Result, &tx); err != nil || tx.BlockNumber == nil || *tx.BlockNumber < 0 ||
+			!t.settled(ctx, uint64(*tx.BlockNumber)) {
+			return
+		}
+		block = uint64(*tx.BlockNumber)
+	}
+	t.cache.add(key, resp.Result, block)
+}
+
+// cacheResponse caches the result of a single request from an upstream
+// response, which is read and replaced with one having the same body.
+func (t *myTransport) cacheResponse(ctx context.Context, r ModifiedRequest, resp *http.Response) (*http.Response, error) {
+	if t.cache == nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return resp, nil
+	}
+	if _, _, ok := t.cacheable(ctx, r); !ok {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream response: %v", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	t.toCache(ctx, r, body)
+	return resp, nil
+}
+
+// cachedResponse returns a response to a single request answered from the cache.
+func cachedResponse(body json.RawMessage) *http.Response {
+	resp := localResponse(body)
+	resp.Header.Set("X-Cache", "HIT")
+	return resp
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResponseCache_evict(t *testing.T) {
+	c := newResponseCache(20, 0)
+	c.add("a", json.RawMessage(`"0x1234"`), 0) // 9 bytes
+	c.add("b", json.RawMessage(`"0x1234"`), 0)
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	c.add("c", json.RawMessage(`"0x1234"`), 0)
+	if _, ok := c.get("b"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("expected recently used entry to be kept")
+	}
+	c.add("d", json.RawMessage(`"0x12345678901234567890"`), 0)
+	if _, ok := c.get("d"); ok {
+		t.Error("expected entry larger than the cache to be skipped")
+	}
+	if c.size() > 20 {
+		t.Errorf("expected at most 20 bytes but got %d", c.size())
+	}
+}
+
+func TestCache(t *testing.T) {
+	node := newFakeNode(t, nodeResults("0x1000"))
+	node.set("eth_getBalance", "0x1")
+	node.set("eth_getTransactionReceipt", map[string]string{"blockNumber": "0x10"})
+	node.set("eth_getTransactionByHash", map[string]interface{}{"blockNumber": nil})
+	s := testServer(t, ConfigData{
+		URL:       node.URL,
+		Allow:     []string{"eth_getBalance", "eth_getTransactionReceipt", "eth_getTransactionByHash"},
+		CacheSize: 1 << 20,
+	})
+
+	for _, tc := range []struct {
+		method string
+		params string
+		cached bool
+	}{
+		{"eth_getBalance", `"0x0000000000000000000000000000000000000000", "0x10"`, true},
+		{"eth_getBalance", `"0x0000000000000000000000000000000000000000", "0xff0"`, false},
+		{"eth_getBalance", `"0x0000000000000000000000000000000000000000", "latest"`, false},
+		{"eth_getTransactionReceipt", `"0x01"`, true},
+		{"eth_getTransactionByHash", `"0x01"`, false}, // Pending.
+	} {
+		for id := 1; id <= 2; id++ {
+			w := postRPC(s, fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"%s","params":[%s]}`, id, tc.method, tc.params))
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), fmt.Sprintf(`"id":%d`, id)) {
+				t.Fatalf("unexpected response %d: %s", w.Code, w.Body)
+			}
+		}
+		calls := node.called(tc.method)
+		if have := calls == 1; have != tc.cached {
+			t.Errorf("%s(%s): expected cached %t but upstream was called %d times", tc.method, tc.params, tc.cached, calls)
+		}
+		node.mu.Lock()
+		node.calls[tc.method] = 0
+		node.mu.Unlock()
+	}
+
+	// Cached elements of a batch are answered without the upstream.
+	w := postRPC(s, `[{"jsonrpc":"2.0","id":7,"method":"eth_getTransactionReceipt","params":["0x01"]},`+
+		`{"jsonrpc":"2.0","id":8,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","latest"]}]`)
+	var resps []json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil || len(resps) != 2 {
+		t.Fatalf("unexpected batch response %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(string(resps[0]), `"id":7`) || !strings.Contains(string(resps[0]), `"blockNumber":"0x10"`) {
+		t.Errorf("expected cached receipt with the caller's id but got %s", resps[0])
+	}
+	if node.called("eth_getTransactionReceipt") != 0 {
+		t.Error("expected cached batch element not to be forwarded")
+	}
+}
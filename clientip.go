@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// ipNets is a list of networks.
+type ipNets []*net.IPNet
+
+// parseIPNets parses a list of CIDRs or single IPs.
+func parseIPNets(list []string) (ipNets, error) {
+	var nets ipNets
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (ns ipNets) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range ns {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ns ipNets) containsString(s string) bool {
+	return ns.contains(net.ParseIP(s))
+}
+
+// getIP returns the original IP address of the request. Forwarding headers are
+// only honored when the immediate peer is a trusted proxy, in which case the
+// rightmost untrusted address is used, checking CF-Connecting-IP, then
+// Forwarded, then X-Forwarded-For.
+func (t *myTransport) getIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !t.trustedProxies.containsString(peer) {
+		return peer
+	}
+	if ip := strings.TrimSpace(r.Header.Get("CF-Connecting-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	chain := forwardedFor(r.Header.Values("Forwarded"))
+	if len(chain) == 0 {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, ip := range strings.Split(v, ",") {
+				chain = append(chain, strings.TrimSpace(ip))
+			}
+		}
+	}
+	// Walk back from the nearest hop, until the first one we don't trust.
+	ip := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		if net.ParseIP(chain[i]) == nil {
+			// Obfuscated or malformed, so nothing further can be trusted.
+			break
+		}
+		ip = chain[i]
+		if !t.trustedProxies.containsString(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the for= addresses of RFC 7239 Forwarded headers, in
+// order. Ports and brackets are removed, and obfuscated identifiers like
+// "unknown" or "_hidden" are kept as is.
+func forwardedFor(values []string) []string {
+	var ips []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+					continue
+				}
+				node := strings.Trim(pair[4:], `"`)
+				if host, _, err := net.SplitHostPort(node); err == nil {
+					node = host
+				}
+				ips = append(ips, strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+			}
+		}
+	}
+	return ips
+}
+
+// proxyProtocolPolicy accepts PROXY protocol headers only from trusted
+// proxies, so other peers can't choose their own address.
+func (ns ipNets) proxyProtocolPolicy(upstream net.Addr) (proxyproto.Policy, error) {
+	if a, ok := upstream.(*net.TCPAddr); ok && ns.contains(a.IP) {
+		return proxyproto.USE, nil
+	}
+	return proxyproto.IGNORE, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestGetIP(t *testing.T) {
+	trusted, err := parseIPNets([]string{"10.0.0.0/8", "fd00::/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &myTransport{trustedProxies: trusted}
+	for _, test := range []struct {
+		name   string
+		remote string
+		header http.Header
+		exp    string
+	}{
+		{name: "direct", remote: "1.1.1.1:1234", exp: "1.1.1.1"},
+		{name: "spoofed", remote: "1.1.1.1:1234", header: http.Header{"X-Forwarded-For": {"2.2.2.2"}, "Cf-Connecting-Ip": {"2.2.2.2"}}, exp: "1.1.1.1"},
+		{name: "cloudflare", remote: "10.0.0.1:1234", header: http.Header{"Cf-Connecting-Ip": {"2.2.2.2"}}, exp: "2.2.2.2"},
+		{name: "xff", remote: "10.0.0.1:1234", header: http.Header{"X-Forwarded-For": {"3.3.3.3, 2.2.2.2"}}, exp: "2.2.2.2"},
+		{name: "xff-chain", remote: "10.0.0.1:1234", header: http.Header{"X-Forwarded-For": {"3.3.3.3", "2.2.2.2, 10.1.1.1"}}, exp: "2.2.2.2"},
+		{name: "xff-all-trusted", remote: "10.0.0.1:1234", header: http.Header{"X-Forwarded-For": {"10.2.2.2, 10.1.1.1"}}, exp: "10.2.2.2"},
+		{name: "forwarded", remote: "192.0.2.1:1234", header: http.Header{"Forwarded": {`for=3.3.3.3, for="[2001:db8::1]:4711";proto=https`}, "X-Forwarded-For": {"4.4.4.4"}}, exp: "2001:db8::1"},
+		{name: "forwarded-obfuscated", remote: "[fd00::1]:1234", header: http.Header{"Forwarded": {"for=_hidden, For=10.1.1.1"}}, exp: "10.1.1.1"},
+		{name: "no-port", remote: "5.5.5.5", exp: "5.5.5.5"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.RemoteAddr = test.remote
+			for k, v := range test.header {
+				r.Header[k] = v
+			}
+			if got := tr.getIP(r); got != test.exp {
+				t.Errorf("expected %s but got %s", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	trusted, err := parseIPNets([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = &proxyproto.Listener{Listener: ln, Policy: trusted.proxyProtocolPolicy}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	}))
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 5555 80\r\nGET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "203.0.113.7:5555" {
+		t.Errorf("expected address from PROXY header but got %s", body)
+	}
+
+	// Headers from untrusted peers are ignored.
+	untrusted := ipNets{{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(32, 32)}}
+	if p, _ := untrusted.proxyProtocolPolicy(conn.LocalAddr()); p != proxyproto.IGNORE {
+		t.Errorf("expected PROXY header from untrusted peer to be ignored but got %v", p)
+	}
+	if p, _ := (ipNets{}).proxyProtocolPolicy(conn.LocalAddr()); p != proxyproto.IGNORE {
+		t.Errorf("expected PROXY header to be ignored without trusted proxies but got %v", p)
+	}
+	if _, err := (&ConfigData{URL: "http://127.0.0.1:8040", ProxyProtocol: true}).NewServer(); err == nil {
+		t.Error("expected ProxyProtocol without TrustedProxies to be refused")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// readOnlyMethods match requests which can share an upstream response when
+// they are identical and concurrent.
+var readOnlyMethods = mustMatcher(defaultRetryMethods...)
+
+// sharedResponse is an upstream response to identical requests.
+type sharedResponse struct {
+	status    int
+	header    http.Header
+	body      []byte
+	upstreams []string // Hosts tried.
+}
+
+// sharedCall is an upstream call in flight, which is waited on by every
+// identical request.
+type sharedCall struct {
+	done    chan struct{} // Closed when resp and err are set.
+	cancel  context.CancelFunc
+	waiters int // Protected by coalescer.mu.
+
+	resp *sharedResponse
+	err  error
+}
+
+// coalescer collapses identical concurrent requests into a single upstream
+// call. The call is canceled once every request waiting on it is.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*sharedCall
+}
+
+// do returns the result of fn for key, which is only called if no call for key
+// is already in flight. Returns true if the result was shared with another request.
+func (c *coalescer) do(ctx context.Context, key string, fn func(context.Context) (*sharedResponse, error)) (*sharedResponse, bool, error) {
+	c.mu.Lock()
+	call, shared := c.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &sharedCall{done: make(chan struct{}), cancel: cancel}
+		if c.calls == nil {
+			c.calls = make(map[string]*sharedCall)
+		}
+		c.calls[key] = call
+		go func() {
+			call.resp, call.err = fn(callCtx)
+			cancel()
+			c.forget(key, call)
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.resp, shared, call.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Forgotten in the same critical section, so no request can
+			// join a call which is about to be canceled.
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+			call.cancel()
+		}
+		c.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// forget removes call, so later requests for key start a new one.
+func (c *coalescer) forget(key string, call *sharedCall) {
+	c.mu.Lock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	c.mu.Unlock()
+}
+
+// coalesceKey returns the key identifying r among concurrent requests to pool,
+// or false if r must not share a response.
+func coalesceKey(req *http.Request, pool *upstreams, r ModifiedRequest) (string, bool) {
+	if len(r.ID) == 0 || !readOnlyMethods.MatchAnyRule(r.Path) || neverRetry.MatchAnyRule(r.Path) {
+		return "", false
+	}
+	return pool.name + "\x00" + req.URL.RequestURI() + "\x00" + cacheKey(r), true
+}
+
+// forwardShared forwards the single request r like forward, but shares the
+// upstream response with identical requests in flight.
+func (t *myTransport) forwardShared(ctx context.Context, req *http.Request, pool *upstreams, r ModifiedRequest, retry bool) (*http.Response, error) {
+	key, ok := coalesceKey(req, pool, r)
+	if !ok {
+		return t.forward(ctx, req, pool, retry)
+	}
+	shared, ok, err := t.inflight.do(ctx, key, func(ctx context.Context) (*sharedResponse, error) {
+		info := &requestInfo{}
+		ctx = withRequestInfo(ctx, info)
+		out := req.Clone(ctx)
+		// Let the transport decompress, so the body can be shared.
+		out.Header.Del("Accept-Encoding")
+		resp, err := t.forward(ctx, out, pool, retry)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream response: %v", err)
+		}
+		return &sharedResponse{status: resp.StatusCode, header: resp.Header, body: body, upstreams: info.getUpstreams()}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		t.metrics.coalesced()
+	}
+	info := requestInfoFrom(ctx)
+	for _, host := range shared.upstreams {
+		info.addHost(host)
+	}
+	return shared.response(r.ID), nil
+}
+
+// response returns a copy of the shared response, with the id of the caller.
+func (s *sharedResponse) response(id json.RawMessage) *http.Response {
+	body := s.body
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(body, &msg); err == nil && msg["id"] != nil && !bytes.Equal(msg["id"], id) {
+		msg["id"] = id
+		body = mustMarshal(msg)
+	}
+	header := s.header.Clone()
+	header.Del("Content-Length")
+	return &http.Response{
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Header:        header,
+		StatusCode:    s.status,
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescer(t *testing.T) {
+	var c coalescer
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (*sharedResponse, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &sharedResponse{status: 200, body: []byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`)}, nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	var shared int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, ok, err := c.do(context.Background(), "key", fn)
+			if err != nil || resp.status != 200 {
+				t.Errorf("unexpected response %v: %v", resp, err)
+			}
+			if ok {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	for !waiting(&c, "key", n) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if calls != 1 || shared != n-1 {
+		t.Errorf("expected 1 call shared by %d requests but got %d calls and %d shared", n-1, calls, shared)
+	}
+
+	// The call is canceled when no request waits on it anymore.
+	canceled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, _, err := c.do(ctx, "key", func(ctx context.Context) (*sharedResponse, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("expected canceled but got %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("expected upstream call to be canceled")
+	}
+	// Later requests don't join the canceled call.
+	if resp, ok, err := c.do(context.Background(), "key", fn); err != nil || ok || resp.status != 200 {
+		t.Errorf("expected a new call but got %v, shared %t: %v", resp, ok, err)
+	}
+}
+
+func waiting(c *coalescer, key string, n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call, ok := c.calls[key]
+	return ok && call.waiters == n
+}
+
+func TestSharedResponse_response(t *testing.T) {
+	s := &sharedResponse{status: 200, body: []byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`)}
+	body, err := ioutil.ReadAll(s.response(json.RawMessage(`"abc"`)).Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp resultResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.ID) != `"abc"` || string(resp.Result) != `"0x1"` {
+		t.Errorf("expected result with the caller's id but got %s", body)
+	}
+}
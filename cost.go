@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// CostConfig sets how many rate limit tokens calls to matching methods consume.
+type CostConfig struct {
+	Method string `toml:",omitempty"` // Regular expression, like Allow.
+	Cost   int    `toml:",omitempty"` // Tokens per call. 0 means 1.
+	// When set, an additional token is charged for every BlocksPerToken blocks
+	// in the requested range (eth_getLogs only).
+	BlocksPerToken uint64 `toml:",omitempty"`
+}
+
+type cost struct {
+	method         *regexp.Regexp
+	cost           int
+	blocksPerToken uint64
+}
+
+// costs is a table of method costs. The first matching entry applies, and
+// unmatched methods cost 1.
+type costs []cost
+
+func newCosts(cfgs []CostConfig) (costs, error) {
+	var cs costs
+	for _, c := range cfgs {
+		re, err := regexp.Compile(c.Method)
+		if err != nil {
+			return nil, err
+		}
+		if c.Cost < 0 {
+			return nil, fmt.Errorf("negative cost for %s: %d", c.Method, c.Cost)
+		}
+		if c.Cost == 0 {
+			c.Cost = 1
+		}
+		cs = append(cs, cost{method: re, cost: c.Cost, blocksPerToken: c.BlocksPerToken})
+	}
+	return cs, nil
+}
+
+// get returns the cost of a call to method over block range r, which may be
+// nil. The cost is at least 1.
+func (cs costs) get(method string, r *blockRange) int {
+	for _, c := range cs {
+		if !c.method.MatchString(method) {
+			continue
+		}
+		n := c.cost
+		if c.blocksPerToken > 0 && r != nil && r.start <= r.end {
+			if extra := r.len() / c.blocksPerToken; extra < math.MaxInt32 {
+				n += int(extra)
+			} else {
+				n = math.MaxInt32
+			}
+		}
+		if n < 1 {
+			n = 1
+		}
+		return n
+	}
+	return 1
+}
+
+// dynamic returns true if the cost of method depends on its block range.
+func (cs costs) dynamic(method string) bool {
+	for _, c := range cs {
+		if c.method.MatchString(method) {
+			return c.blocksPerToken > 0
+		}
+	}
+	return false
+}
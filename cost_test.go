@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCosts(t *testing.T) {
+	cs, err := newCosts([]CostConfig{
+		{Method: "^eth_getLogs$", Cost: 2, BlocksPerToken: 100},
+		{Method: "^debug_", Cost: 10},
+		{Method: "^eth_"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		method string
+		r      *blockRange
+		want   int
+	}{
+		{"eth_getLogs", nil, 2},
+		{"eth_getLogs", &blockRange{start: 1, end: 50}, 2},
+		{"eth_getLogs", &blockRange{start: 0, end: 999}, 12},
+		{"eth_getLogs", &blockRange{start: 100, end: 0}, 2},
+		{"eth_getLogs", &blockRange{start: 0, end: math.MaxUint64 - 1}, math.MaxInt32},
+		{"debug_traceTransaction", nil, 10},
+		{"eth_chainId", nil, 1},
+		{"net_version", nil, 1},
+	} {
+		if have := cs.get(tc.method, tc.r); have != tc.want {
+			t.Errorf("%s %v: want cost %d but have %d", tc.method, tc.r, tc.want, have)
+		}
+	}
+	if !cs.dynamic("eth_getLogs") || cs.dynamic("debug_traceTransaction") {
+		t.Error("expected only eth_getLogs to be dynamic")
+	}
+}
+
+func TestCosts_invalidRange(t *testing.T) {
+	node := newFakeNode(t, nodeResults("0x10"))
+	node.set("eth_getLogs", []string{})
+	s := testServer(t, ConfigData{
+		URL:   node.URL,
+		RPM:   100,
+		Allow: []string{"eth_getLogs"},
+		Costs: []CostConfig{{Method: "^eth_getLogs$", BlocksPerToken: 1}},
+	})
+	const logs = `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"%s","toBlock":"%s"}]}`
+	if w := postRPC(s, fmt.Sprintf(logs, "0x64", "0x0")); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "-32602") {
+		t.Errorf("expected reversed range to be invalid but got %d: %s", w.Code, w.Body)
+	}
+	if w := postRPC(s, fmt.Sprintf(logs, "0x0", "0x7")); w.Code != http.StatusOK {
+		t.Fatalf("expected request to drain the burst but got %d: %s", w.Code, w.Body)
+	}
+	if w := postRPC(s, fmt.Sprintf(logs, "0x64", "0x0")); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected reversed range not to refill the bucket but got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAllowVisitor_cost(t *testing.T) {
+	requestsPerMinuteLimit = 100
+	ls := limiters{store: newMemoryStore(time.Minute)}
+	r := ModifiedRequest{RemoteAddr: "1.2.3.4"}
+	if allowed, _ := ls.AllowVisitor(context.Background(), r, 6); !allowed {
+		t.Fatal("expected first request to be allowed")
+	}
+	if allowed, _ := ls.AllowVisitor(context.Background(), r, 6); allowed {
+		t.Fatal("expected request exceeding the remaining tokens to be blocked")
+	}
+	if allowed, _ := ls.AllowVisitor(context.Background(), r, 4); !allowed {
+		t.Fatal("expected request within the remaining tokens to be allowed")
+	}
+	// Negative costs would refill the bucket.
+	if allowed, _ := ls.AllowVisitor(context.Background(), r, -98); allowed {
+		t.Fatal("expected request with a negative cost to be blocked")
+	}
+	if allowed, _ := ls.AllowVisitor(context.Background(), r, 1); allowed {
+		t.Fatal("expected tokens not to be refilled")
+	}
+}
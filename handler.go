@@ -4,28 +4,39 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/big"
-	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/gochain/gochain/v3/goclient"
 	"github.com/gochain/gochain/v3/rpc"
 	"github.com/treeder/gotils/v2"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type myTransport struct {
-	blockRangeLimit uint64 // 0 means none
+	current atomic.Pointer[settings] // Swapped when the config is reloaded.
+
+	transport http.RoundTripper
+
+	trustedProxies ipNets // Peers whose forwarding headers are honored.
 
-	matcher
 	limiters
+	abuse *abuseDetector
+
+	cache    *responseCache // nil when disabled.
+	inflight coalescer      // Identical requests waiting on an upstream.
+
+	metrics   *metrics
+	accessLog *accessLog // nil when disabled.
 
 	latestBlock
+	servedHead uint64 // atomic, the highest eth_blockNumber answered.
 }
 
 type ModifiedRequest struct {
@@ -33,6 +44,8 @@ type ModifiedRequest struct {
 	RemoteAddr string // Original IP, not CloudFlare or load balancer.
 	ID         json.RawMessage
 	Params     []json.RawMessage
+	Raw        json.RawMessage // The complete request, or batch element.
+	Key        *apiKey         // The API key used, if any.
 }
 
 func isBatch(msg []byte) bool {
@@ -45,35 +58,27 @@ func isBatch(msg []byte) bool {
 	return false
 }
 
-// getIP returns the original IP address from the request, checking special headers before falling back to RemoteAddr.
-func getIP(r *http.Request) string {
-	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
-		return ip
-	}
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		// Trim off any others: A.B.C.D[,X.X.X.X,Y.Y.Y.Y,]
-		return strings.SplitN(ip, ",", 1)[0]
-	}
-	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		return ip
-	}
-	return r.RemoteAddr
-}
-
-func parseRequests(r *http.Request) (string, []string, []ModifiedRequest, error) {
+// parseRequests returns the original IP, methods and requests, and whether the body is a batch.
+func (t *myTransport) parseRequests(r *http.Request) (string, []string, []ModifiedRequest, bool, error) {
 	var res []ModifiedRequest
 	var methods []string
-	ip := getIP(r)
+	var batch bool
+	ip := t.getIP(r)
 	if r.Body != nil {
-		body, err := ioutil.ReadAll(r.Body)
+		lim := t.settings().requestLimits
+		body, err := lim.readBody(r)
 		r.Body.Close()
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(body)) // must be done, even when err
-		if err != nil {
-			return "", nil, nil, fmt.Errorf("failed to read body: %v", err)
+		setBody(r, body) // must be done, even when err
+		if _, ok := err.(*limitError); ok {
+			return "", nil, nil, false, err
+		} else if err != nil {
+			return "", nil, nil, false, fmt.Errorf("failed to read body: %v", err)
 		}
-		methods, res, err = parseMessage(body, ip)
+		r.ContentLength = int64(len(body))
+		batch = isBatch(body)
+		methods, res, err = parseMessage(body, ip, lim)
 		if err != nil {
-			return "", nil, nil, err
+			return "", nil, nil, false, err
 		}
 	}
 	if len(res) == 0 {
@@ -83,28 +88,39 @@ func parseRequests(r *http.Request) (string, []string, []ModifiedRequest, error)
 			RemoteAddr: ip,
 		})
 	}
-	return ip, methods, res, nil
+	return ip, methods, res, batch, nil
 }
 
-func parseMessage(body []byte, ip string) (methods []string, res []ModifiedRequest, err error) {
+func parseMessage(body []byte, ip string, lim requestLimits) (methods []string, res []ModifiedRequest, err error) {
 	type rpcRequest struct {
 		ID     json.RawMessage   `json:"id"`
 		Method string            `json:"method"`
 		Params []json.RawMessage `json:"params"`
 	}
+	if err := lim.checkDepth(body); err != nil {
+		return nil, nil, err
+	}
 	if isBatch(body) {
-		var arr []rpcRequest
+		var arr []json.RawMessage
 		err := json.Unmarshal(body, &arr)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to parse JSON batch request: %v", err)
 		}
-		for _, t := range arr {
+		if err := lim.checkBatch(len(arr)); err != nil {
+			return nil, nil, err
+		}
+		for _, raw := range arr {
+			var t rpcRequest
+			if err := json.Unmarshal(raw, &t); err != nil {
+				return nil, nil, fmt.Errorf("failed to parse JSON batch request: %v", err)
+			}
 			methods = append(methods, t.Method)
 			res = append(res, ModifiedRequest{
 				ID:         t.ID,
 				Path:       t.Method,
 				RemoteAddr: ip,
 				Params:     t.Params,
+				Raw:        raw,
 			})
 		}
 	} else {
@@ -119,11 +135,14 @@ func parseMessage(body []byte, ip string) (methods []string, res []ModifiedReque
 			Path:       t.Method,
 			RemoteAddr: ip,
 			Params:     t.Params,
+			Raw:        body,
 		})
 	}
 	return methods, res, nil
 }
 
+var errNoUpstream = errors.New("No upstream available")
+
 const (
 	jsonRPCTimeout       = -32000
 	jsonRPCUnavailable   = -32601
@@ -151,6 +170,16 @@ func jsonRPCError(id json.RawMessage, jsonCode int, msg string) interface{} {
 	return resp
 }
 
+type resultResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result"`
+}
+
+func jsonRPCResult(id, result json.RawMessage) interface{} {
+	return resultResponse{Version: "2.0", ID: id, Result: result}
+}
+
 func jsonRPCUnauthorized(id json.RawMessage, method string) interface{} {
 	return jsonRPCError(id, jsonRPCUnavailable, "You are not authorized to make this request: "+method)
 }
@@ -159,6 +188,10 @@ func jsonRPCLimit(id json.RawMessage) interface{} {
 	return jsonRPCError(id, jsonRPCTimeout, "You hit the request limit")
 }
 
+func jsonRPCDenied(id json.RawMessage) interface{} {
+	return jsonRPCError(id, jsonRPCInvalidRequest, "Your IP is not allowed to make requests")
+}
+
 func jsonRPCBlockRangeLimit(id json.RawMessage, blocks, limit uint64) interface{} {
 	return jsonRPCError(id, jsonRPCInvalidParams, fmt.Sprintf("Requested range of blocks (%d) is larger than limit (%d).", blocks, limit))
 }
@@ -179,15 +212,75 @@ func jsonRPCResponse(httpCode int, v interface{}) (*http.Response, error) {
 	}, nil
 }
 
-func (t *myTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	ctx := req.Context()
-	if reqID := middleware.GetReqID(req.Context()); reqID != "" {
+// localResponse returns a response to a single request answered by the proxy.
+func localResponse(body json.RawMessage) *http.Response {
+	return &http.Response{
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		StatusCode:    http.StatusOK,
+	}
+}
+
+func (t *myTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	start := time.Now()
+	info := &requestInfo{}
+	ctx := withRequestInfo(req.Context(), info)
+	reqID := middleware.GetReqID(req.Context())
+	if reqID != "" {
 		ctx = gotils.With(ctx, "requestID", reqID)
 	}
 
-	ip, methods, parsedRequests, err := parseRequests(req)
-	if err != nil {
+	var ip string
+	var methods []string
+	var parsedRequests []ModifiedRequest
+	var batch bool
+	defer func() {
+		code := http.StatusBadGateway
+		if res != nil {
+			code = res.StatusCode
+		}
+		t.metrics.observeRequests(methods, code, t.settings().labeled, batch)
+
+		entry := &accessLogEntry{
+			Time:      start,
+			RequestID: reqID,
+			Transport: "http",
+			IP:        ip,
+			Methods:   methods,
+			Upstreams: info.getUpstreams(),
+			Status:    code,
+			BytesIn:   req.ContentLength,
+		}
+		if key := apiKeyFrom(ctx); key != nil {
+			entry.APIKey = key.name
+		}
+		if batch {
+			entry.BatchSize = len(methods)
+		}
+		if res != nil {
+			res.Body = t.accessLog.logBody(res.Body, entry, start)
+		} else {
+			entry.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+			t.accessLog.log(entry)
+		}
+	}()
+
+	_, span := tracer().Start(ctx, "parse")
+	ip, methods, parsedRequests, batch, err = t.parseRequests(req)
+	span.SetAttributes(attribute.StringSlice("rpc.methods", methods))
+	endSpan(span, err)
+	if le, ok := err.(*limitError); ok {
+		gotils.L(ctx).Info().Printf("Request blocked: %v", err)
+		t.metrics.rejected(rejectRequestLimit)
+		resp, err := jsonRPCResponse(le.httpCode, le.response())
+		if err != nil {
+			gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+		}
+		return resp, nil
+	} else if err != nil {
 		gotils.L(ctx).Error().Printf("Failed to parse requests: %v", err)
+		t.metrics.rejected(rejectInvalid)
 		resp, err := jsonRPCResponse(http.StatusBadRequest, jsonRPCError(json.RawMessage("1"), jsonRPCInvalidParams, err.Error()))
 		if err != nil {
 			gotils.L(ctx).Error().Printf("Failed to construct invalid params response: %v", err)
@@ -197,58 +290,171 @@ func (t *myTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 	ctx = gotils.With(ctx, "remoteIp", ip)
 	ctx = gotils.With(ctx, "methods", methods)
-	errorCode, resp := t.block(ctx, parsedRequests)
-	if resp != nil {
-		resp, err := jsonRPCResponse(errorCode, resp)
+	if key := apiKeyFrom(ctx); key != nil {
+		ctx = gotils.With(ctx, "apiKey", key.name)
+		setKey(parsedRequests, key)
+	}
+	// Blocked, local and cached elements of a batch are answered individually, and
+	// the rest are forwarded.
+	responses := make([]json.RawMessage, len(parsedRequests))
+	httpCode := http.StatusOK
+	var blocked bool
+	if !batch {
+		errorCode, resp := t.block(ctx, parsedRequests)
+		if resp != nil {
+			resp, err := jsonRPCResponse(errorCode, resp)
+			if err != nil {
+				gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
+			}
+			return resp, nil
+		}
+	} else if codes, resps := t.check(ctx, parsedRequests); anyBlocked(resps) {
+		for i, resp := range resps {
+			if resp != nil {
+				responses[i] = mustMarshal(resp)
+			}
+		}
+		httpCode = blockedCode(codes)
+		blocked = true
+	}
+	local := t.fromStatic(ctx, parsedRequests, responses) + t.fromHead(parsedRequests, responses)
+	hits := t.fromCache(ctx, parsedRequests, responses)
+	if local > 0 && !batch {
+		return localResponse(responses[0]), nil
+	} else if hits > 0 && !batch {
+		return cachedResponse(responses[0]), nil
+	} else if local > 0 || hits > 0 || blocked {
+		return t.forwardBatch(ctx, req, parsedRequests, responses, httpCode)
+	}
+
+	// gotils.L(ctx).Debug().Print("Forwarding request")
+	pool, ok := t.poolFor(ctx, parsedRequests)
+	if maxBatch := t.settings().maxUpstreamBatch; !ok || (maxBatch > 0 && len(parsedRequests) > maxBatch) {
+		return t.forwardBatch(ctx, req, parsedRequests, responses, http.StatusOK)
+	}
+	var upResp *http.Response
+	if batch && hasMethod(parsedRequests, "eth_blockNumber") && t.settings().blockNumberMaxAge > 0 {
+		// Split, so each head can be raised.
+		return t.forwardBatch(ctx, req, parsedRequests, responses, http.StatusOK)
+	} else if batch {
+		upResp, err = t.forward(ctx, req, pool, t.retryable(parsedRequests))
+	} else {
+		upResp, err = t.forwardShared(ctx, req, pool, parsedRequests[0], t.retryable(parsedRequests))
+	}
+	if err == errNoUpstream {
+		gotils.L(ctx).Error().Print("No upstream available")
+		resp, err := jsonRPCResponse(http.StatusServiceUnavailable, jsonRPCError(parsedRequests[0].ID, jsonRPCInternal, err.Error()))
 		if err != nil {
 			gotils.L(ctx).Error().Printf("Failed to construct a response: %v", err)
 		}
 		return resp, nil
+	} else if err != nil || batch {
+		return upResp, err
+	} else if parsedRequests[0].Path == "eth_blockNumber" {
+		return t.raiseHeadResponse(parsedRequests[0], upResp)
 	}
-
-	// gotils.L(ctx).Debug().Print("Forwarding request")
-	req.Host = req.RemoteAddr //workaround for CloudFlare
-	return http.DefaultTransport.RoundTrip(req)
+	return t.cacheResponse(ctx, parsedRequests[0], upResp)
 }
 
 // block returns a response only if the request should be blocked, otherwise it returns nil if allowed.
 func (t *myTransport) block(ctx context.Context, parsedRequests []ModifiedRequest) (int, interface{}) {
+	codes, resps := t.check(ctx, parsedRequests)
+	for i, resp := range resps {
+		if resp != nil {
+			return codes[i], resp
+		}
+	}
+	return 0, nil
+}
+
+// check returns an HTTP status code and response for each request which
+// should be blocked, or nil for those which are allowed.
+func (t *myTransport) check(ctx context.Context, parsedRequests []ModifiedRequest) ([]int, []interface{}) {
+	ctx, span := tracer().Start(ctx, "check")
+	defer span.End()
+	codes := make([]int, len(parsedRequests))
+	resps := make([]interface{}, len(parsedRequests))
 	var union *blockRange
-	for _, parsedRequest := range parsedRequests {
-		ctx = gotils.With(ctx, "ip", parsedRequest.RemoteAddr)
-		if allowed, _ := t.AllowVisitor(parsedRequest); !allowed {
-			gotils.L(ctx).Info().Print("Request blocked: Rate limited")
-			return http.StatusTooManyRequests, jsonRPCLimit(parsedRequest.ID)
-		} //else if added {
-		// gotils.L(ctx).Debug().Printf("Added new visitor, ip: %v", parsedRequest.RemoteAddr)
-		// }
-
-		if !t.MatchAnyRule(parsedRequest.Path) {
-			// gotils.L(ctx).Debug().Print("Request blocked: Method not allowed")
-			return http.StatusMethodNotAllowed, jsonRPCUnauthorized(parsedRequest.ID, parsedRequest.Path)
+	var blocked int
+	for i, parsedRequest := range parsedRequests {
+		ctx := gotils.With(ctx, "ip", parsedRequest.RemoteAddr)
+		codes[i], resps[i] = t.checkOne(ctx, parsedRequest, &union)
+		if resps[i] != nil {
+			blocked++
 		}
-		if t.blockRangeLimit > 0 && parsedRequest.Path == "eth_getLogs" {
-			r, invalid, err := t.parseRange(ctx, parsedRequest)
-			if err != nil {
-				return http.StatusInternalServerError, jsonRPCError(parsedRequest.ID, jsonRPCInternal, err.Error())
-			} else if invalid != nil {
-				gotils.L(ctx).Info().Printf("Request blocked: Invalid params: %v", invalid)
-				return http.StatusBadRequest, jsonRPCError(parsedRequest.ID, jsonRPCInvalidParams, invalid.Error())
+	}
+	span.SetAttributes(attribute.Int("rpc.blocked", blocked))
+	return codes, resps
+}
+
+// checkOne returns a response only if the request should be blocked. The block
+// range of allowed eth_getLogs requests is added to union.
+func (t *myTransport) checkOne(ctx context.Context, parsedRequest ModifiedRequest, union **blockRange) (int, interface{}) {
+	st := t.settings()
+	// The range is needed up front when it affects the cost.
+	var r *blockRange
+	var invalid, err error
+	checkRange := parsedRequest.Path == "eth_getLogs" && (st.blockRangeLimit > 0 || st.costs.dynamic(parsedRequest.Path))
+	if checkRange {
+		r, invalid, err = t.parseRange(ctx, parsedRequest)
+	}
+
+	if t.denied(parsedRequest.RemoteAddr) {
+		gotils.L(ctx).Info().Print("Request blocked: IP denied")
+		t.metrics.rejected(rejectDenied)
+		return http.StatusForbidden, jsonRPCDenied(parsedRequest.ID)
+	}
+	visitorID, visitorName := t.visitorID(parsedRequest)
+	if until, ok := t.abuse.banned(visitorID); ok {
+		gotils.L(ctx).Info().Print("Request blocked: Banned")
+		t.metrics.rejected(rejectBanned)
+		return http.StatusForbidden, jsonRPCBan(parsedRequest.ID, until)
+	}
+	if allowed, _ := t.AllowVisitor(ctx, parsedRequest, st.costs.get(parsedRequest.Path, r)); !allowed {
+		gotils.L(ctx).Info().Print("Request blocked: Rate limited")
+		t.metrics.rejected(rejectRateLimit)
+		t.abuse.reject(ctx, visitorID, visitorName)
+		return http.StatusTooManyRequests, jsonRPCLimit(parsedRequest.ID)
+	} //else if added {
+	// gotils.L(ctx).Debug().Printf("Added new visitor, ip: %v", parsedRequest.RemoteAddr)
+	// }
+
+	allow := st.matcher
+	if k := parsedRequest.Key; k != nil && k.matcher != nil {
+		allow = k.matcher
+	}
+	if !allow.MatchAnyRule(parsedRequest.Path) {
+		// gotils.L(ctx).Debug().Print("Request blocked: Method not allowed")
+		t.metrics.rejected(rejectUnauthorized)
+		t.abuse.reject(ctx, visitorID, visitorName)
+		return http.StatusMethodNotAllowed, jsonRPCUnauthorized(parsedRequest.ID, parsedRequest.Path)
+	}
+	if checkRange && invalid != nil {
+		gotils.L(ctx).Info().Printf("Request blocked: Invalid params: %v", invalid)
+		t.metrics.rejected(rejectInvalid)
+		return http.StatusBadRequest, jsonRPCError(parsedRequest.ID, jsonRPCInvalidParams, invalid.Error())
+	}
+	if checkRange && st.blockRangeLimit > 0 {
+		if err != nil {
+			return http.StatusInternalServerError, jsonRPCError(parsedRequest.ID, jsonRPCInternal, err.Error())
+		}
+		if r != nil {
+			if l := r.len(); l > st.blockRangeLimit {
+				gotils.L(ctx).Info().Println("Request blocked: Exceeds block range limit, range:", l, "limit:", st.blockRangeLimit)
+				t.metrics.rejected(rejectBlockRange)
+				return http.StatusBadRequest, jsonRPCBlockRangeLimit(parsedRequest.ID, l, st.blockRangeLimit)
 			}
-			if r != nil {
-				if l := r.len(); l > t.blockRangeLimit {
-					gotils.L(ctx).Info().Println("Request blocked: Exceeds block range limit, range:", l, "limit:", t.blockRangeLimit)
-					return http.StatusBadRequest, jsonRPCBlockRangeLimit(parsedRequest.ID, l, t.blockRangeLimit)
-				}
-				if union == nil {
-					union = r
-				} else {
-					union.extend(r)
-					if l := union.len(); l > t.blockRangeLimit {
-						gotils.L(ctx).Info().Println("Request blocked: Exceeds block range limit, range:", l, "limit:", t.blockRangeLimit)
-						return http.StatusBadRequest, jsonRPCBlockRangeLimit(parsedRequest.ID, l, t.blockRangeLimit)
-					}
+			if *union == nil {
+				*union = r
+			} else {
+				extended := **union
+				extended.extend(r)
+				if l := extended.len(); l > st.blockRangeLimit {
+					gotils.L(ctx).Info().Println("Request blocked: Exceeds block range limit, range:", l, "limit:", st.blockRangeLimit)
+					t.metrics.rejected(rejectBlockRange)
+					return http.StatusBadRequest, jsonRPCBlockRangeLimit(parsedRequest.ID, l, st.blockRangeLimit)
 				}
+				*union = &extended
 			}
 		}
 	}
@@ -319,16 +525,23 @@ func (t *myTransport) parseRange(ctx context.Context, request ModifiedRequest) (
 			end = uint64(*fq.ToBlock)
 		}
 	}
+	if start > end {
+		return nil, fmt.Errorf("invalid block range: fromBlock %d is after toBlock %d", start, end), nil
+	}
 
 	return &blockRange{start: start, end: end}, nil, nil
 }
 
+// latestBlock tracks the best head among the upstreams. Each update also
+// checks the health of every upstream.
 type latestBlock struct {
-	url    string
-	client *goclient.Client
+	interval time.Duration
+	heads    headTracker // Used instead of polling while subscribed.
 
 	mu sync.RWMutex // Protects everything below.
 
+	pools []*upstreams // Every pool, the default first.
+
 	next chan struct{} // Set when an update is running, and closed when the next result is available.
 
 	num uint64
@@ -337,10 +550,13 @@ type latestBlock struct {
 }
 
 func (l *latestBlock) get(ctx context.Context) (uint64, error) {
+	if num, _, ok := l.subscribedHead(); ok {
+		return num, nil
+	}
 	l.mu.RLock()
 	next, num, err, at := l.next, l.num, l.err, l.at
 	l.mu.RUnlock()
-	if at != nil && time.Since(*at) < 5*time.Second {
+	if at != nil && time.Since(*at) < l.interval {
 		return num, err
 	}
 	if next == nil {
@@ -364,6 +580,32 @@ func (l *latestBlock) get(ctx context.Context) (uint64, error) {
 
 }
 
+func (l *latestBlock) getPools() []*upstreams {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.pools
+}
+
+func (l *latestBlock) setPools(pools []*upstreams) {
+	l.mu.Lock()
+	l.pools = pools
+	l.mu.Unlock()
+}
+
+// head returns the last known head, and when it was updated, without calling
+// an upstream.
+func (l *latestBlock) head() (uint64, time.Time) {
+	if num, at, ok := l.subscribedHead(); ok {
+		return num, at
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.at == nil {
+		return 0, time.Time{}
+	}
+	return l.num, *l.at
+}
+
 // update updates (num, err, at). Only one instance may run at a time, and it
 // spot is reserved by setting next, which is closed when the operation completes.
 // Returns a chan to wait on if another instance is already running. Otherwise
@@ -379,18 +621,10 @@ func (l *latestBlock) update() (chan struct{}, uint64, error) {
 	l.next = next
 	l.mu.Unlock()
 
-	var latest uint64
-	var err error
-	if l.client == nil {
-		l.client, err = goclient.Dial(l.url)
-	}
-	if err == nil {
-		var lBig *big.Int
-		lBig, err = l.client.LatestBlockNumber(context.Background())
-		if err == nil {
-			latest = lBig.Uint64()
-		}
-	}
+	ctx, span := tracer().Start(context.Background(), "latestBlock.update")
+	latest, err := checkPools(ctx, l.getPools(), l.interval)
+	span.SetAttributes(attribute.Int64("block.number", int64(latest)))
+	endSpan(span, err)
 	now := time.Now()
 
 	l.mu.Lock()
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gochain/gochain/v3/common"
+	"github.com/gochain/gochain/v3/common/hexutil"
+	"github.com/gochain/gochain/v3/rpc"
+	"github.com/treeder/gotils/v2"
+)
+
+// headWindow is how many recent block hashes are kept to detect reorgs.
+const headWindow = 128
+
+// chainHead is the part of a block header used to follow the chain.
+type chainHead struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       common.Hash    `json:"hash"`
+	ParentHash common.Hash    `json:"parentHash"`
+}
+
+// headTracker follows the chain through new heads, and detects reorgs by
+// keeping the hashes of recent blocks.
+type headTracker struct {
+	onReorg func(ctx context.Context, fork uint64) // Called when blocks from fork on were replaced.
+
+	mu     sync.RWMutex // Protects everything below.
+	live   bool         // Set while subscribed.
+	hashes map[uint64]common.Hash
+	num    uint64
+	at     time.Time
+}
+
+// current returns the head and when it arrived, or false if not subscribed.
+func (ht *headTracker) current() (uint64, time.Time, bool) {
+	ht.mu.RLock()
+	defer ht.mu.RUnlock()
+	if !ht.live || ht.at.IsZero() {
+		return 0, time.Time{}, false
+	}
+	return ht.num, ht.at, true
+}
+
+func (ht *headTracker) setLive(live bool) {
+	ht.mu.Lock()
+	ht.live = live
+	ht.mu.Unlock()
+}
+
+// add records h as the new head. When it doesn't extend the known chain, its
+// ancestors are fetched until they join it, and blocks which were replaced are
+// reported to onReorg.
+func (ht *headTracker) add(ctx context.Context, h chainHead, fetch func(context.Context, common.Hash) (chainHead, error)) error {
+	ht.mu.RLock()
+	known := make(map[uint64]common.Hash, len(ht.hashes))
+	lowest := ^uint64(0)
+	for num, hash := range ht.hashes {
+		known[num] = hash
+		if num < lowest {
+			lowest = num
+		}
+	}
+	ht.mu.RUnlock()
+
+	// Walk back from h until it joins the known chain.
+	var chain []chainHead
+	for cur := h; ; {
+		num := uint64(cur.Number)
+		if hash, ok := known[num]; ok && hash == cur.Hash {
+			break
+		}
+		chain = append(chain, cur)
+		if num == 0 || num-1 < lowest || len(chain) > headWindow {
+			break
+		}
+		if hash, ok := known[num-1]; ok && hash == cur.ParentHash {
+			break
+		}
+		parent, err := fetch(ctx, cur.ParentHash)
+		if err != nil {
+			return fmt.Errorf("failed to get block %s: %v", cur.ParentHash.Hex(), err)
+		}
+		cur = parent
+	}
+	if len(chain) == 0 {
+		return nil // Already known.
+	}
+	fork := uint64(chain[len(chain)-1].Number)
+
+	ht.mu.Lock()
+	if ht.hashes == nil {
+		ht.hashes = make(map[uint64]common.Hash)
+	}
+	var reorg bool
+	for num := range ht.hashes {
+		if num >= fork {
+			reorg = true
+			delete(ht.hashes, num)
+		}
+	}
+	for _, c := range chain {
+		ht.hashes[uint64(c.Number)] = c.Hash
+	}
+	ht.num = uint64(h.Number)
+	ht.at = time.Now()
+	for num := range ht.hashes {
+		if num+headWindow <= ht.num {
+			delete(ht.hashes, num)
+		}
+	}
+	ht.mu.Unlock()
+
+	if reorg && ht.onReorg != nil {
+		ht.onReorg(ctx, fork)
+	}
+	return nil
+}
+
+// subscribedHead returns the head from the new heads subscription, unless it
+// is older than the poll interval, like when the stream stalled, or behind the
+// polled head.
+func (l *latestBlock) subscribedHead() (uint64, time.Time, bool) {
+	num, at, ok := l.heads.current()
+	if !ok || time.Since(at) >= l.interval {
+		return 0, time.Time{}, false
+	}
+	l.mu.RLock()
+	polled, err := l.num, l.err
+	l.mu.RUnlock()
+	if err == nil && polled > num {
+		return 0, time.Time{}, false
+	}
+	return num, at, true
+}
+
+// blockNumber returns the head to answer eth_blockNumber with, or false if it
+// isn't known or is older than maxAge. It never returns a lower head than
+// before, even when the best upstream changes.
+func (t *myTransport) blockNumber(maxAge time.Duration) (uint64, bool) {
+	num, at := t.latestBlock.head()
+	if maxAge <= 0 || num == 0 || time.Since(at) >= maxAge {
+		return 0, false
+	}
+	return t.serveHead(num), true
+}
+
+// serveHead returns num, or the highest head answered before if that is higher.
+func (t *myTransport) serveHead(num uint64) uint64 {
+	for {
+		served := atomic.LoadUint64(&t.servedHead)
+		if num <= served {
+			return served
+		}
+		if atomic.CompareAndSwapUint64(&t.servedHead, served, num) {
+			return num
+		}
+	}
+}
+
+// raiseHead returns the upstream response to the eth_blockNumber request r,
+// with a result lower than a head answered before raised to it, so the head
+// never goes backwards when the request goes to a lagging upstream.
+func (t *myTransport) raiseHead(r ModifiedRequest, response json.RawMessage) json.RawMessage {
+	if r.Path != "eth_blockNumber" || t.settings().blockNumberMaxAge <= 0 {
+		return response
+	}
+	var resp struct {
+		Result *hexutil.Uint64 `json:"result"`
+	}
+	if err := json.Unmarshal(response, &resp); err != nil || resp.Result == nil {
+		return response
+	}
+	num := uint64(*resp.Result)
+	if served := t.serveHead(num); served != num {
+		return mustMarshal(jsonRPCResult(r.ID, mustMarshal(hexutil.Uint64(served))))
+	}
+	return response
+}
+
+// raiseHeadResponse applies raiseHead to a single upstream response, which is
+// read and replaced.
+func (t *myTransport) raiseHeadResponse(r ModifiedRequest, resp *http.Response) (*http.Response, error) {
+	if r.Path != "eth_blockNumber" || t.settings().blockNumberMaxAge <= 0 ||
+		resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream response: %v", err)
+	}
+	body = t.raiseHead(r, body)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// fromHead fills in the responses of eth_blockNumber requests while the head
+// is fresh, and returns how many there were. Requests which already have a
+// response are skipped.
+func (t *myTransport) fromHead(parsedRequests []ModifiedRequest, responses []json.RawMessage) int {
+	maxAge := t.settings().blockNumberMaxAge
+	var n int
+	for i, r := range parsedRequests {
+		if responses[i] != nil || len(r.ID) == 0 || r.Path != "eth_blockNumber" {
+			continue
+		}
+		if num, ok := t.blockNumber(maxAge); ok {
+			responses[i] = mustMarshal(jsonRPCResult(r.ID, mustMarshal(hexutil.Uint64(num))))
+			n++
+		}
+	}
+	return n
+}
+
+// subscribe follows new heads over the websocket of an upstream in the default
+// pool until ctx is done, reconnecting after failures. The polled head is used
+// while it isn't connected, or the subscription falls behind.
+func (l *latestBlock) subscribe(ctx context.Context) {
+	for {
+		err := l.follow(ctx)
+		l.heads.setLive(false)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err == errLeftRotation:
+			gotils.L(ctx).Info().Print("Stopped following new heads: upstream left rotation")
+		case err != nil && err != errNoWSUpstream:
+			gotils.L(ctx).Error().Printf("Failed to follow new heads: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.interval):
+		}
+	}
+}
+
+var errNoWSUpstream = errors.New("no healthy upstream with a websocket")
+
+// wsUpstream returns a healthy upstream of the default pool with a websocket.
+func (l *latestBlock) wsUpstream() *upstream {
+	pools := l.getPools()
+	if len(pools) == 0 {
+		return nil
+	}
+	for _, u := range pools[0].list {
+		if u.wsURL != nil && u.available() {
+			return u
+		}
+	}
+	return nil
+}
+
+// errLeftRotation is returned by follow when its upstream should no longer be followed.
+var errLeftRotation = errors.New("upstream left rotation")
+
+// following returns true while up is in rotation in the default pool.
+func (l *latestBlock) following(up *upstream) bool {
+	pools := l.getPools()
+	return len(pools) > 0 && containsUpstream(pools[0].list, up) && up.available()
+}
+
+func (l *latestBlock) follow(ctx context.Context) error {
+	up := l.wsUpstream()
+	if up == nil {
+		return errNoWSUpstream
+	}
+	client, err := rpc.DialContext(ctx, up.wsURL.String())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	ch := make(chan chainHead, 16)
+	// Closing the client ends the subscription, without waiting on a stalled upstream.
+	sub, err := client.EthSubscribe(ctx, ch, "newHeads")
+	if err != nil {
+		return err
+	}
+	gotils.L(ctx).Info().Printf("Following new heads from %s", up.wsURL.Host)
+	l.heads.setLive(true)
+
+	fetch := func(ctx context.Context, hash common.Hash) (chainHead, error) {
+		var h *chainHead
+		if err := client.CallContext(ctx, &h, "eth_getBlockByHash", hash, false); err != nil {
+			return chainHead{}, err
+		}
+		if h == nil {
+			return chainHead{}, errors.New("not found")
+		}
+		return *h, nil
+	}
+	check := time.NewTicker(l.interval)
+	defer check.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-sub.Err():
+			return err
+		case <-check.C:
+			if !l.following(up) {
+				return errLeftRotation
+			}
+		case h := <-ch:
+			if !l.following(up) {
+				return errLeftRotation
+			}
+			ctx, cancel := context.WithTimeout(ctx, l.interval)
+			err := l.heads.add(ctx, h, fetch)
+			cancel()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
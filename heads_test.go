@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gochain/gochain/v3/common"
+	"github.com/gochain/gochain/v3/common/hexutil"
+	"github.com/gorilla/websocket"
+)
+
+// testChain builds heads where each fork has its own hashes.
+type testChain map[common.Hash]chainHead
+
+func (c testChain) head(num uint64, fork, parentFork byte) chainHead {
+	h := chainHead{
+		Number:     hexutil.Uint64(num),
+		Hash:       common.Hash{fork, byte(num)},
+		ParentHash: common.Hash{parentFork, byte(num - 1)},
+	}
+	c[h.Hash] = h
+	return h
+}
+
+func (c testChain) fetch(_ context.Context, hash common.Hash) (chainHead, error) {
+	h, ok := c[hash]
+	if !ok {
+		return chainHead{}, errors.New("not found")
+	}
+	return h, nil
+}
+
+func TestHeadTracker(t *testing.T) {
+	var forks []uint64
+	ht := headTracker{onReorg: func(_ context.Context, fork uint64) { forks = append(forks, fork) }}
+	ctx := context.Background()
+	chain := testChain{}
+	add := func(h chainHead) {
+		t.Helper()
+		if err := ht.add(ctx, h, chain.fetch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := uint64(1); i <= 10; i++ {
+		add(chain.head(i, 'a', 'a'))
+	}
+	// Missed heads are filled in without a reorg.
+	chain.head(11, 'a', 'a')
+	add(chain.head(12, 'a', 'a'))
+	if len(forks) != 0 {
+		t.Fatalf("expected no reorg but got %v", forks)
+	}
+	// A sibling of the head.
+	add(chain.head(12, 'b', 'a'))
+	// A longer fork from block 9.
+	chain.head(9, 'c', 'a')
+	chain.head(10, 'c', 'c')
+	chain.head(11, 'c', 'c')
+	chain.head(12, 'c', 'c')
+	add(chain.head(13, 'c', 'c'))
+	if len(forks) != 2 || forks[0] != 12 || forks[1] != 9 {
+		t.Errorf("expected reorgs from blocks 12 and 9 but got %v", forks)
+	}
+	ht.setLive(true)
+	if num, _, ok := ht.current(); !ok || num != 13 {
+		t.Errorf("expected head 13 but got %d", num)
+	}
+}
+
+func TestResponseCache_invalidate(t *testing.T) {
+	c := newResponseCache(1<<20, 0)
+	c.add("hash", json.RawMessage(`"a"`), 0)
+	c.add("old", json.RawMessage(`"b"`), 5)
+	c.add("new", json.RawMessage(`"c"`), 10)
+	if n := c.invalidate(8); n != 1 {
+		t.Errorf("expected 1 invalidated result but got %d", n)
+	}
+	for key, exp := range map[string]bool{"hash": true, "old": true, "new": false} {
+		if _, ok := c.get(key); ok != exp {
+			t.Errorf("%s: expected cached %t", key, exp)
+		}
+	}
+}
+
+// newFakeHeadsNode serves a newHeads subscription, sending every head from heads.
+func newFakeHeadsNode(t *testing.T, heads <-chan chainHead) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var req fakeRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+		conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": "0x1"})
+		for h := range heads {
+			conn.WriteJSON(map[string]interface{}{"jsonrpc": "2.0", "method": "eth_subscription",
+				"params": map[string]interface{}{"subscription": "0x1", "result": h}})
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestLatestBlock_subscribe(t *testing.T) {
+	heads := make(chan chainHead)
+	defer close(heads)
+	ws := newFakeHeadsNode(t, heads)
+	node := newFakeNode(t, nodeResults("0x1"))
+	s := testServer(t, ConfigData{Upstreams: []UpstreamConfig{{URL: node.URL, WSURL: "ws" + strings.TrimPrefix(ws.URL, "http")}}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.latestBlock.subscribe(ctx)
+
+	heads <- chainHead{Number: 0x20, Hash: common.Hash{1}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if num, _ := s.latestBlock.head(); num == 0x20 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected head from the subscription")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if num, err := s.latestBlock.get(ctx); err != nil || num != 0x20 {
+		t.Errorf("expected head 0x20 but got %d: %v", num, err)
+	}
+	if node.called("eth_blockNumber") != 0 {
+		t.Error("expected head without calling the upstream")
+	}
+
+	// A stalled subscription falls back to polling.
+	s.latestBlock.heads.mu.Lock()
+	s.latestBlock.heads.at = time.Now().Add(-time.Hour)
+	s.latestBlock.heads.mu.Unlock()
+	if num, err := s.latestBlock.get(ctx); err != nil || num != 1 {
+		t.Errorf("expected polled head 1 but got %d: %v", num, err)
+	}
+
+	// The upstream is no longer followed once it leaves rotation.
+	s.settings().upstreams.list[0].setHealthy(ctx, false, "test")
+	heads <- chainHead{Number: 0x21, Hash: common.Hash{2}, ParentHash: common.Hash{1}}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, _, ok := s.latestBlock.heads.current(); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected subscription to be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBlockNumber(t *testing.T) {
+	node := newFakeNode(t, nodeResults("0x10"))
+	s := testServer(t, ConfigData{URL: node.URL, Allow: []string{"eth_blockNumber"}, BlockNumberMaxAge: time.Minute})
+	const blockNumber = `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`
+	if w := postRPC(s, blockNumber); !strings.Contains(w.Body.String(), `"0x10"`) {
+		t.Fatalf("expected head from the upstream but got %s", w.Body)
+	}
+	if _, _, err := s.latestBlock.update(); err != nil {
+		t.Fatal(err)
+	}
+	calls := node.called("eth_blockNumber")
+	if w := postRPC(s, blockNumber); !strings.Contains(w.Body.String(), `"0x10"`) || node.called("eth_blockNumber") != calls {
+		t.Errorf("expected tracked head without calling the upstream but got %s", w.Body)
+	}
+
+	// The head never goes backwards.
+	node.set("eth_blockNumber", "0x8")
+	if _, _, err := s.latestBlock.update(); err != nil {
+		t.Fatal(err)
+	}
+	if w := postRPC(s, blockNumber); !strings.Contains(w.Body.String(), `"0x10"`) {
+		t.Errorf("expected head not to go backwards but got %s", w.Body)
+	}
+
+	// A stale head is fetched from the upstream, but still doesn't go backwards.
+	if err := s.reload(&ConfigData{URL: node.URL, Allow: []string{"eth_blockNumber"}, BlockNumberMaxAge: time.Nanosecond}); err != nil {
+		t.Fatal(err)
+	}
+	calls = node.called("eth_blockNumber")
+	if w := postRPC(s, blockNumber); !strings.Contains(w.Body.String(), `"0x10"`) || !strings.Contains(w.Body.String(), `"id":1`) {
+		t.Errorf("expected lower upstream head to be raised but got %s", w.Body)
+	}
+	if node.called("eth_blockNumber") == calls {
+		t.Error("expected stale head to be fetched from the upstream")
+	}
+	w := postRPC(s, `[{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber","params":[]}]`)
+	if !strings.Contains(w.Body.String(), `"0x10"`) || !strings.Contains(w.Body.String(), `"id":2`) {
+		t.Errorf("expected lower upstream head in a batch to be raised but got %s", w.Body)
+	}
+
+	// Higher upstream heads are served from then on.
+	node.set("eth_blockNumber", "0x20")
+	postRPC(s, blockNumber)
+	node.set("eth_blockNumber", "0x18")
+	if w := postRPC(s, blockNumber); !strings.Contains(w.Body.String(), `"0x20"`) {
+		t.Errorf("expected forwarded head to be remembered but got %s", w.Body)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gochain/gochain/v3/common/hexutil"
+	"github.com/gochain/gochain/v3/rpc"
+	"github.com/treeder/gotils/v2"
+)
+
+const (
+	defaultHealthInterval = 5 * time.Second
+	defaultMaxBlockLag    = 5
+)
+
+// health is the result of probing a single upstream.
+type health struct {
+	head       uint64
+	netVersion string
+	syncing    bool
+	err        error // Set when the upstream is unreachable.
+}
+
+// probe queries the upstream for its head, network and sync status in a single batch.
+func (u *upstream) probe(ctx context.Context) health {
+	if u.client == nil {
+		c, err := rpc.DialContext(ctx, u.url.String())
+		if err != nil {
+			return health{err: err}
+		}
+		u.client = c
+	}
+	var (
+		head       hexutil.Big
+		netVersion string
+		syncing    rawJSON
+	)
+	batch := []rpc.BatchElem{
+		{Method: "eth_blockNumber", Result: &head},
+		{Method: "net_version", Result: &netVersion},
+		{Method: "eth_syncing", Result: &syncing},
+	}
+	if err := u.client.BatchCallContext(ctx, batch); err != nil {
+		return health{err: err}
+	}
+	for _, b := range batch {
+		if b.Error != nil {
+			return health{err: fmt.Errorf("%s: %v", b.Method, b.Error)}
+		}
+	}
+	return health{
+		head:       (*big.Int)(&head).Uint64(),
+		netVersion: netVersion,
+		// eth_syncing returns false, or an object describing the progress.
+		syncing: !bytes.Equal(syncing, []byte("false")),
+	}
+}
+
+// rawJSON captures a result without decoding it.
+type rawJSON []byte
+
+func (r *rawJSON) UnmarshalJSON(b []byte) error {
+	*r = append((*r)[:0], b...)
+	return nil
+}
+
+// available reports whether u is currently in rotation.
+func (u *upstream) available() bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0
+}
+
+// setHealthy puts u in or out of rotation, logging any change.
+func (u *upstream) setHealthy(ctx context.Context, healthy bool, reason string) {
+	var v int32
+	if !healthy {
+		v = 1
+	}
+	if old := atomic.SwapInt32(&u.unhealthy, v); old != v {
+		if healthy {
+			gotils.L(ctx).Info().Printf("Upstream %s returned to rotation", u)
+		} else {
+			u.static.Store(nil)
+			gotils.L(ctx).Error().Printf("Upstream %s removed from rotation: %s", u, reason)
+		}
+	}
+}
+
+// checkHealth probes every upstream concurrently and removes those which are
+// unreachable, syncing, on another network, or more than maxBlockLag blocks
+// behind the best head. Returns the best head among healthy upstreams.
+func (us *upstreams) checkHealth(ctx context.Context, timeout time.Duration) (uint64, error) {
+	results := make([]health, len(us.list))
+	var wg sync.WaitGroup
+	for i, u := range us.list {
+		wg.Add(1)
+		go func(i int, u *upstream) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			results[i] = u.probe(ctx)
+			if results[i].err == nil {
+				if err := u.learn(ctx); err != nil {
+					gotils.L(ctx).Error().Printf("Failed to get static results from upstream %s: %v", u, err)
+				}
+			}
+		}(i, u)
+	}
+	wg.Wait()
+
+	us.netVersion = expectedNetwork(results, us.netVersion)
+	var best uint64
+	var found bool
+	var firstErr error
+	for _, h := range results {
+		if h.err != nil {
+			if firstErr == nil {
+				firstErr = h.err
+			}
+			continue
+		}
+		if !h.syncing && h.netVersion == us.netVersion && (!found || h.head > best) {
+			best = h.head
+			found = true
+		}
+	}
+
+	for i, u := range us.list {
+		h := results[i]
+		atomic.StoreUint64(&u.head, h.head)
+		switch {
+		case h.err != nil:
+			u.setHealthy(ctx, false, fmt.Sprintf("unreachable: %v", h.err))
+		case h.syncing:
+			u.setHealthy(ctx, false, "syncing")
+		case h.netVersion != us.netVersion:
+			u.setHealthy(ctx, false, fmt.Sprintf("wrong network: %s (expected %s)", h.netVersion, us.netVersion))
+		case h.head+us.maxBlockLag < best:
+			u.setHealthy(ctx, false, fmt.Sprintf("lagging: head %d is %d blocks behind %d", h.head, best-h.head, best))
+		default:
+			u.setHealthy(ctx, true, "")
+		}
+	}
+
+	if !found {
+		if firstErr == nil {
+			firstErr = errors.New("no healthy upstream")
+		}
+		return 0, firstErr
+	}
+	return best, nil
+}
+
+// expectedNetwork returns the network of most reachable upstreams, so a single
+// misconfigured node can't eject the others. Ties keep the previous network, or
+// else go to the first upstream in list order.
+func expectedNetwork(results []health, previous string) string {
+	votes := make(map[string]int)
+	for _, h := range results {
+		if h.err == nil {
+			votes[h.netVersion]++
+		}
+	}
+	expected := previous
+	for _, h := range results {
+		if h.err == nil && votes[h.netVersion] > votes[expected] {
+			expected = h.netVersion
+		}
+	}
+	return expected
+}
+
+// checkPools checks the health of every pool concurrently, and returns the best
+// head among them.
+func checkPools(ctx context.Context, pools []*upstreams, timeout time.Duration) (uint64, error) {
+	heads := make([]uint64, len(pools))
+	errs := make([]error, len(pools))
+	var wg sync.WaitGroup
+	for i, p := range pools {
+		wg.Add(1)
+		go func(i int, p *upstreams) {
+			defer wg.Done()
+			heads[i], errs[i] = p.checkHealth(ctx, timeout)
+		}(i, p)
+	}
+	wg.Wait()
+
+	var best uint64
+	var found bool
+	var firstErr error
+	for i := range pools {
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("pool %s: %v", pools[i].name, errs[i])
+			}
+			continue
+		}
+		if !found || heads[i] > best {
+			best = heads[i]
+			found = true
+		}
+	}
+	if !found {
+		return 0, firstErr
+	}
+	return best, nil
+}
+
+// poll keeps the latest block and upstream health up to date until ctx is done.
+func (l *latestBlock) poll(ctx context.Context) {
+	t := time.NewTicker(l.interval)
+	defer t.Stop()
+	for {
+		if _, _, err := l.update(); err != nil {
+			gotils.L(ctx).Error().Printf("Failed to check upstream health: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
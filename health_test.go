@@ -0,0 +1,190 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode is a minimal JSON-RPC server returning canned results by method.
+type fakeNode struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	results map[string]interface{}
+	calls   map[string]int
+	status  int  // When set, every request fails with this HTTP status.
+	gzip    bool // When set, responses are gzipped for clients accepting it.
+}
+
+func newFakeNode(t *testing.T, results map[string]interface{}) *fakeNode {
+	n := &fakeNode{results: results, calls: map[string]int{}}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.serve))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *fakeNode) set(method string, result interface{}) {
+	n.mu.Lock()
+	n.results[method] = result
+	n.mu.Unlock()
+}
+
+func (n *fakeNode) fail(status int) {
+	n.mu.Lock()
+	n.status = status
+	n.mu.Unlock()
+}
+
+func (n *fakeNode) compress() {
+	n.mu.Lock()
+	n.gzip = true
+	n.mu.Unlock()
+}
+
+func (n *fakeNode) called(method string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls[method]
+}
+
+type fakeRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+func (n *fakeNode) respond(req fakeRequest) map[string]interface{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls[req.Method]++
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	if res, ok := n.results[req.Method]; ok {
+		resp["result"] = res
+	} else {
+		resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+	}
+	return resp
+}
+
+func (n *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n.mu.Lock()
+	status, compress := n.status, n.gzip
+	n.mu.Unlock()
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var out io.Writer = w
+	if compress && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	if isBatch(body) {
+		var reqs []fakeRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var resps []interface{}
+		for _, req := range reqs {
+			resps = append(resps, n.respond(req))
+		}
+		json.NewEncoder(out).Encode(resps)
+		return
+	}
+	var req fakeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(out).Encode(n.respond(req))
+}
+
+func nodeResults(head string) map[string]interface{} {
+	return map[string]interface{}{
+		"eth_blockNumber": head,
+		"net_version":     "60",
+		"eth_syncing":     false,
+	}
+}
+
+func TestUpstreams_checkHealth(t *testing.T) {
+	a := newFakeNode(t, nodeResults("0x64"))
+	b := newFakeNode(t, nodeResults("0x60"))
+	c := newFakeNode(t, nodeResults("0x64"))
+	c.set("eth_syncing", map[string]string{"currentBlock": "0x64", "highestBlock": "0x100"})
+	d := newFakeNode(t, nodeResults("0x64"))
+	d.set("net_version", "1")
+
+	us, err := newUpstreams([]UpstreamConfig{{URL: a.URL}, {URL: b.URL}, {URL: c.URL}, {URL: d.URL}}, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	best, err := us.checkHealth(ctx, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if best != 0x64 {
+		t.Errorf("expected best head 0x64 but got %#x", best)
+	}
+	for i, want := range []bool{true, false, false, false} {
+		if have := us.list[i].available(); have != want {
+			t.Errorf("upstream %d: expected available %t but got %t", i, want, have)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if u := us.pick(); u != us.list[0] {
+			t.Fatalf("expected only healthy upstream but got: %s", u)
+		}
+	}
+
+	// Catching up returns the node to rotation.
+	b.set("eth_blockNumber", "0x63")
+	if _, err := us.checkHealth(ctx, time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !us.list[1].available() {
+		t.Error("expected caught up upstream to be available")
+	}
+
+	// Unreachable nodes are removed.
+	a.Close()
+	if _, err := us.checkHealth(ctx, time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if us.list[0].available() {
+		t.Error("expected unreachable upstream to be unavailable")
+	}
+
+	// The expected network is the one most upstreams are on, whatever their order.
+	e := newFakeNode(t, nodeResults("0x64"))
+	us, err = newUpstreams([]UpstreamConfig{{URL: d.URL}, {URL: b.URL}, {URL: e.URL}}, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.checkHealth(ctx, time.Second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, want := range []bool{false, true, true} {
+		if have := us.list[i].available(); have != want {
+			t.Errorf("upstream %d: expected available %t but got %t", i, want, have)
+		}
+	}
+}
@@ -1,45 +1,312 @@
 package main
 
 import (
+	"context"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/treeder/gotils/v2"
 	"golang.org/x/time/rate"
 )
 
+const defaultVisitorTTL = 10 * time.Minute
+
+// Default prefix lengths which IPs are aggregated by. A single IPv6 host
+// usually has a whole /64.
+const (
+	defaultIPv4Prefix = 32
+	defaultIPv6Prefix = 64
+)
+
+// limiterStore holds the rate limit state of visitors.
+type limiterStore interface {
+	// allow consumes n tokens from the visitor id, which is allowed rpm
+	// requests per minute with a burst of burst. It returns whether the
+	// request is allowed, and whether the visitor is new.
+	allow(ctx context.Context, id string, rpm, burst, n int) (allowed, added bool, err error)
+}
+
 type limiters struct {
-	noLimitIPs map[string]struct{} // concurrent read safe after init.
-	visitors   map[string]*rate.Limiter
+	ipv4Prefix int // IPv4 addresses in the same prefix share a limit.
+	ipv6Prefix int // IPv6 addresses in the same prefix share a limit.
+	store      limiterStore
+
+	rpm int64 // atomic, overrides requestsPerMinuteLimit when set.
+
+	mu      sync.RWMutex // Protects noLimit and deny.
+	noLimit ipNets       // Exempt from rate limiting.
+	deny    ipNets       // Always blocked.
+}
+
+// getRPM returns the rate limit of IPs, in requests per minute.
+func (ls *limiters) getRPM() int {
+	if rpm := atomic.LoadInt64(&ls.rpm); rpm > 0 {
+		return int(rpm)
+	}
+	return requestsPerMinuteLimit
+}
+
+func (ls *limiters) setRPM(rpm int) {
+	atomic.StoreInt64(&ls.rpm, int64(rpm))
+}
+
+// exempt returns true if ip is in the NoLimit list.
+func (ls *limiters) exempt(ip string) bool {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.noLimit.containsString(ip)
+}
+
+// noLimitList returns the NoLimit networks.
+func (ls *limiters) noLimitList() []string {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	list := []string{}
+	for _, n := range ls.noLimit {
+		list = append(list, n.String())
+	}
+	return list
+}
+
+// addNoLimit adds an IP or CIDR to the NoLimit list.
+func (ls *limiters) addNoLimit(s string) error {
+	nets, err := parseIPNets([]string{s})
+	if err != nil {
+		return err
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, n := range ls.noLimit {
+		if n.String() == nets[0].String() {
+			return nil
+		}
+	}
+	ls.noLimit = append(ls.noLimit[:len(ls.noLimit):len(ls.noLimit)], nets[0])
+	return nil
+}
+
+// removeNoLimit removes an IP or CIDR from the NoLimit list, and returns false
+// if it wasn't there.
+func (ls *limiters) removeNoLimit(s string) bool {
+	nets, err := parseIPNets([]string{s})
+	if err != nil {
+		return false
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for i, n := range ls.noLimit {
+		if n.String() == nets[0].String() {
+			ls.noLimit = append(ls.noLimit[:i:i], ls.noLimit[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// denied returns true if the IP is on the deny list.
+func (ls *limiters) denied(ip string) bool {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.deny.containsString(ip)
+}
+
+// setLists replaces the NoLimit and deny lists.
+func (ls *limiters) setLists(noLimit, deny ipNets) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.noLimit, ls.deny = noLimit, deny
+}
+
+// ipVisitorID returns the rate limiter id of ip, which is the network of the
+// aggregation prefix containing it.
+func (ls *limiters) ipVisitorID(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	bits, prefix := 8*net.IPv6len, ls.ipv6Prefix
+	if ip4 := parsed.To4(); ip4 != nil {
+		parsed, bits, prefix = ip4, 8*net.IPv4len, ls.ipv4Prefix
+	}
+	if prefix <= 0 || prefix >= bits {
+		return parsed.String()
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String()
+}
+
+// visitorID returns the id of the visitor making r, which is a hash of its API
+// key, or else its IP network, and a name for it which doesn't reveal the key.
+func (ls *limiters) visitorID(r ModifiedRequest) (id, name string) {
+	if k := r.Key; k != nil {
+		return k.visitorID(), "key:" + k.name
+	}
+	id = ls.ipVisitorID(r.RemoteAddr)
+	return id, id
+}
+
+// AllowVisitor consumes cost tokens from the limiter of the request's API key,
+// or of its IP when it has none. Costs larger than the burst are charged the
+// full burst. Requests are allowed when the store fails.
+func (ls *limiters) AllowVisitor(ctx context.Context, r ModifiedRequest, cost int) (allowed, added bool) {
+	if cost < 1 {
+		// Would add tokens back.
+		gotils.L(ctx).Error().Printf("Invalid rate limit cost: %d", cost)
+		return false, false
+	}
+	rpm := ls.getRPM()
+	if k := r.Key; k != nil {
+		if k.noLimit {
+			return true, false
+		}
+		if k.rpm > 0 {
+			rpm = k.rpm
+		}
+	} else if ls.exempt(r.RemoteAddr) {
+		return true, false
+	}
+	id, _ := ls.visitorID(r)
+	burst := rpm / 10
+	if burst > 0 && cost > burst {
+		cost = burst
+	}
+	allowed, added, err := ls.store.allow(ctx, id, rpm, burst, cost)
+	if err != nil {
+		gotils.L(ctx).Error().Printf("Failed to check rate limit: %v", err)
+		return true, false
+	}
+	return allowed, added
+}
+
+// janitor evicts idle visitors from an in-memory store until ctx is done.
+// Other stores expire visitors themselves.
+func (ls *limiters) janitor(ctx context.Context) {
+	if m, ok := ls.store.(*memoryStore); ok {
+		m.janitor(ctx)
+	}
+}
+
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen int64 // atomic, unix nanoseconds.
+}
+
+func (v *visitor) seen() {
+	atomic.StoreInt64(&v.lastSeen, time.Now().UnixNano())
+}
+
+// memoryStore is a limiterStore local to this process.
+type memoryStore struct {
+	visitors   map[string]*visitor
+	visitorTTL time.Duration // Visitors idle this long are evicted.
 	sync.RWMutex
 }
 
-func (ls *limiters) tryAddVisitor(ip string) (*rate.Limiter, bool) {
-	ls.Lock()
-	defer ls.Unlock()
-	limiter, exists := ls.visitors[ip]
+func newMemoryStore(visitorTTL time.Duration) *memoryStore {
+	return &memoryStore{visitors: make(map[string]*visitor), visitorTTL: visitorTTL}
+}
+
+func (m *memoryStore) tryAddVisitor(id string, rpm, burst int) (*rate.Limiter, bool) {
+	m.Lock()
+	defer m.Unlock()
+	v, exists := m.visitors[id]
 	if exists {
-		return limiter, false
+		v.seen()
+		return v.limiter, false
 	}
-	limit := rate.Every(time.Minute / time.Duration(requestsPerMinuteLimit))
-	limiter = rate.NewLimiter(limit, requestsPerMinuteLimit/10)
-	ls.visitors[ip] = limiter
-	return limiter, true
+	limit := rate.Every(time.Minute / time.Duration(rpm))
+	v = &visitor{limiter: rate.NewLimiter(limit, burst)}
+	v.seen()
+	m.visitors[id] = v
+	return v.limiter, true
 }
 
-func (ls *limiters) getVisitor(ip string) (*rate.Limiter, bool) {
-	ls.RLock()
-	limiter, exists := ls.visitors[ip]
-	ls.RUnlock()
+func (m *memoryStore) getVisitor(id string, rpm, burst int) (*rate.Limiter, bool) {
+	m.RLock()
+	v, exists := m.visitors[id]
+	if exists {
+		v.seen()
+	}
+	m.RUnlock()
 	if !exists {
-		return ls.tryAddVisitor(ip)
+		return m.tryAddVisitor(id, rpm, burst)
 	}
-	return limiter, false
+	return v.limiter, false
 }
 
-func (ls *limiters) AllowVisitor(r ModifiedRequest) (allowed, added bool) {
-	if _, ok := ls.noLimitIPs[r.RemoteAddr]; ok {
-		return true, false
+func (m *memoryStore) allow(_ context.Context, id string, rpm, burst, n int) (bool, bool, error) {
+	limiter, added := m.getVisitor(id, rpm, burst)
+	if limit := rate.Every(time.Minute / time.Duration(rpm)); limiter.Limit() != limit {
+		// The RPM was changed.
+		limiter.SetLimit(limit)
+		limiter.SetBurst(burst)
+	}
+	return limiter.AllowN(time.Now(), n), added, nil
+}
+
+// visitorInfo describes the rate limit state of a visitor.
+type visitorInfo struct {
+	Visitor  string    `json:"visitor"`
+	Tokens   float64   `json:"tokens"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// list returns every visitor, with the most recently seen first.
+func (m *memoryStore) list() []visitorInfo {
+	now := time.Now()
+	m.RLock()
+	list := make([]visitorInfo, 0, len(m.visitors))
+	for id, v := range m.visitors {
+		list = append(list, visitorInfo{
+			Visitor:  id,
+			Tokens:   v.limiter.TokensAt(now),
+			LastSeen: time.Unix(0, atomic.LoadInt64(&v.lastSeen)),
+		})
+	}
+	m.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
+
+// size returns the number of tracked visitors.
+func (m *memoryStore) size() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.visitors)
+}
+
+// evictIdle removes visitors which have not been seen since before, and
+// returns how many were removed.
+func (m *memoryStore) evictIdle(before time.Time) int {
+	cutoff := before.UnixNano()
+	m.Lock()
+	defer m.Unlock()
+	var n int
+	for id, v := range m.visitors {
+		if atomic.LoadInt64(&v.lastSeen) < cutoff {
+			delete(m.visitors, id)
+			n++
+		}
+	}
+	return n
+}
+
+// janitor periodically evicts idle visitors until ctx is done. Limiters refill
+// completely within a minute, so evicting idle visitors loses no state.
+func (m *memoryStore) janitor(ctx context.Context) {
+	t := time.NewTicker(m.visitorTTL / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if n := m.evictIdle(now.Add(-m.visitorTTL)); n > 0 {
+				gotils.L(ctx).Info().Printf("Evicted %d idle visitors, remaining: %d", n, m.size())
+			}
+		}
 	}
-	limiter, added := ls.getVisitor(r.RemoteAddr)
-	return limiter.Allow(), added
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+func TestMemoryStore_evictIdle(t *testing.T) {
+	requestsPerMinuteLimit = 100
+	m := newMemoryStore(time.Minute)
+	ls := limiters{store: m}
+	ls.AllowVisitor(context.Background(), ModifiedRequest{RemoteAddr: "1.1.1.1"}, 1)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	ls.AllowVisitor(context.Background(), ModifiedRequest{RemoteAddr: "2.2.2.2"}, 1)
+
+	if n := m.evictIdle(cutoff); n != 1 {
+		t.Errorf("expected 1 evicted visitor but got %d", n)
+	}
+	if _, ok := m.visitors["2.2.2.2"]; !ok || m.size() != 1 {
+		t.Errorf("expected only the active visitor to remain: %v", m.visitors)
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	requestsPerMinuteLimit = 100
+
+	// Two replicas share the same counters.
+	var replicas []*limiters
+	for i := 0; i < 2; i++ {
+		s, err := newRedisStore("redis://" + mr.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas = append(replicas, &limiters{store: s})
+	}
+	ip := ModifiedRequest{RemoteAddr: "1.2.3.4"}
+	for i := 0; i < 10; i++ {
+		allowed, added := replicas[i%2].AllowVisitor(ctx, ip, 1)
+		if !allowed {
+			t.Fatalf("expected request %d within the burst to be allowed", i)
+		}
+		if added != (i == 0) {
+			t.Errorf("expected only the first request to add a visitor, request %d added: %t", i, added)
+		}
+	}
+	if allowed, _ := replicas[0].AllowVisitor(ctx, ip, 1); allowed {
+		t.Error("expected request over the shared burst to be blocked")
+	}
+
+	// API keys are limited separately from IPs.
+	key := ModifiedRequest{RemoteAddr: "1.2.3.4", Key: &apiKey{key: "k", rpm: 1000}}
+	if allowed, _ := replicas[1].AllowVisitor(ctx, key, 100); !allowed {
+		t.Error("expected request with a key to be allowed")
+	}
+	if !mr.Exists(redisKeyPrefix + key.Key.visitorID()) {
+		t.Error("expected key visitor to be stored")
+	}
+	if ttl := mr.TTL(redisKeyPrefix + "1.2.3.4"); ttl <= 0 || ttl > 7*time.Second {
+		t.Errorf("expected visitor to expire once refilled but ttl is %s", ttl)
+	}
+
+	// Requests are allowed when redis is unavailable.
+	mr.Close()
+	if allowed, _ := replicas[0].AllowVisitor(ctx, ip, 1); !allowed {
+		t.Error("expected request to be allowed when redis fails")
+	}
+}
+
+func TestLimiters_ipVisitorID(t *testing.T) {
+	ls := limiters{ipv4Prefix: 24, ipv6Prefix: 64}
+	for ip, exp := range map[string]string{
+		"1.2.3.4":              "1.2.3.0/24",
+		"::ffff:1.2.3.4":       "1.2.3.0/24",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+		"2001:db8:1:2:ffff::1": "2001:db8:1:2::/64",
+		"not-an-ip":            "not-an-ip",
+	} {
+		if got := ls.ipVisitorID(ip); got != exp {
+			t.Errorf("%s: expected %s but got %s", ip, exp, got)
+		}
+	}
+	ls = limiters{ipv4Prefix: 32, ipv6Prefix: 128}
+	if got := ls.ipVisitorID("2001:db8::1"); got != "2001:db8::1" {
+		t.Errorf("expected full address but got %s", got)
+	}
+}
+
+func TestLimiters_cidrs(t *testing.T) {
+	requestsPerMinuteLimit = 10
+	noLimit, _ := parseIPNets([]string{"10.0.0.0/8", "2001:db8::1"})
+	deny, _ := parseIPNets([]string{"192.0.2.0/24"})
+	ls := limiters{noLimit: noLimit, deny: deny, ipv4Prefix: 32, ipv6Prefix: 64, store: newMemoryStore(time.Minute)}
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if allowed, _ := ls.AllowVisitor(ctx, ModifiedRequest{RemoteAddr: "10.1.2.3"}, 1); !allowed {
+			t.Fatal("expected IP in exempt range to be allowed")
+		}
+	}
+	if !ls.denied("192.0.2.55") || ls.denied("10.1.2.3") {
+		t.Error("expected only IPs in the deny list to be denied")
+	}
+
+	// Addresses in the same /64 share a burst of 1.
+	if allowed, _ := ls.AllowVisitor(ctx, ModifiedRequest{RemoteAddr: "2001:db8:0:1::1"}, 1); !allowed {
+		t.Fatal("expected first request to be allowed")
+	}
+	if allowed, _ := ls.AllowVisitor(ctx, ModifiedRequest{RemoteAddr: "2001:db8:0:1::2"}, 1); allowed {
+		t.Error("expected request from the same /64 to be limited")
+	}
+	if allowed, _ := ls.AllowVisitor(ctx, ModifiedRequest{RemoteAddr: "2001:db8:0:2::1"}, 1); !allowed {
+		t.Error("expected request from another /64 to be allowed")
+	}
+}
+
+func TestWSProxy_denied(t *testing.T) {
+	var dialed int32
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&dialed, 1)
+	}))
+	defer ws.Close()
+	node := newFakeNode(t, nodeResults("0x10"))
+	s := testServer(t, ConfigData{
+		Upstreams: []UpstreamConfig{{URL: node.URL, WSURL: "ws" + strings.TrimPrefix(ws.URL, "http")}},
+		Deny:      []string{"127.0.0.1"},
+	})
+	proxy := httptest.NewServer(http.HandlerFunc(s.WSProxy))
+	defer proxy.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected denied IP to be refused the handshake but got %v: %v", resp, err)
+	}
+	if atomic.LoadInt32(&dialed) != 0 {
+		t.Error("expected no upstream websocket for a denied IP")
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	toml "github.com/pelletier/go-toml"
+	"github.com/pires/go-proxyproto"
 	"github.com/rs/cors"
 	"github.com/treeder/gcputils"
 	"github.com/treeder/gotils/v2"
@@ -28,6 +31,67 @@ type ConfigData struct {
 	RPM             int      `toml:",omitempty"`
 	NoLimit         []string `toml:",omitempty"`
 	BlockRangeLimit uint64   `toml:",omitempty"`
+
+	Upstreams []UpstreamConfig `toml:",omitempty"` // Overrides URL and WSURL when set.
+	Balance   string           `toml:",omitempty"` // round-robin (default), least-in-flight or weighted.
+
+	HealthInterval time.Duration `toml:",omitempty"` // How often upstreams are probed. Default 5s.
+	MaxBlockLag    uint64        `toml:",omitempty"` // Upstreams further behind the best head are ejected. Default 5.
+
+	Retries         int           `toml:",omitempty"` // Attempts on other upstreams after a failure. Default 2, negative disables.
+	RetryMethods    []string      `toml:",omitempty"` // Methods which may be retried. Defaults to common read-only methods.
+	UpstreamTimeout time.Duration `toml:",omitempty"` // Time to wait for upstream response headers. 0 means none.
+
+	BreakerFailures  int           `toml:",omitempty"` // Consecutive failures which open an upstream's circuit. Default 5, negative disables.
+	BreakerErrorRate float64       `toml:",omitempty"` // Error rate (0-1) within BreakerWindow which opens the circuit. 0 disables.
+	BreakerWindow    time.Duration `toml:",omitempty"` // Default 1m.
+	BreakerCooldown  time.Duration `toml:",omitempty"` // Time before a probe request is let through an open circuit. Default 30s.
+
+	Pools  []PoolConfig  `toml:",omitempty"` // Named pools in addition to the default pool of Upstreams.
+	Routes []RouteConfig `toml:",omitempty"` // Routes from methods to pools. Unmatched requests use the default pool.
+
+	MaxUpstreamBatch int `toml:",omitempty"` // Larger batches are split across upstreams. 0 means none.
+
+	MaxBodyBytes int64 `toml:",omitempty"` // Maximum size of a request body or websocket message. 0 means none.
+	MaxBatchSize int   `toml:",omitempty"` // Maximum number of requests in a batch. 0 means none.
+	MaxJSONDepth int   `toml:",omitempty"` // Maximum nesting depth of request JSON. 0 means none.
+
+	Costs []CostConfig `toml:",omitempty"` // Rate limit tokens per method. Unmatched methods cost 1.
+
+	VisitorTTL time.Duration `toml:",omitempty"` // Rate limit state of IPs idle this long is dropped. Default 10m.
+	RedisURL   string        `toml:",omitempty"` // Share rate limits between replicas through Redis. Empty means in memory.
+
+	TrustedProxies []string `toml:",omitempty"` // CIDRs of proxies whose forwarding headers are honored.
+	ProxyProtocol  bool     `toml:",omitempty"` // Accept PROXY protocol v1/v2 headers on the listener.
+
+	Deny       []string `toml:",omitempty"` // IPs or CIDRs which are always blocked.
+	IPv4Prefix int      `toml:",omitempty"` // IPv4 addresses are rate limited per prefix of this length. Default 32.
+	IPv6Prefix int      `toml:",omitempty"` // IPv6 addresses are rate limited per prefix of this length. Default 64.
+
+	BanThreshold   int           `toml:",omitempty"` // Rejected requests within BanWindow which get a visitor banned. 0 disables.
+	BanWindow      time.Duration `toml:",omitempty"` // Default 1m.
+	BanDuration    time.Duration `toml:",omitempty"` // Length of the first ban, doubled for each repeat. Default 1m.
+	MaxBanDuration time.Duration `toml:",omitempty"` // Longest ban, and how long until bans are forgiven. Default 24h.
+
+	AccessLog       string  `toml:",omitempty"` // Write a JSON line per request to stdout, stderr or a file. Empty disables.
+	AccessLogSample float64 `toml:",omitempty"` // Fraction (0-1) of successful requests logged. Failures always are. 0 means all.
+
+	OTLPEndpoint string  `toml:",omitempty"` // OTLP/HTTP collector to export traces to, like "http://localhost:4318". Empty disables.
+	TraceSample  float64 `toml:",omitempty"` // Fraction (0-1) of traces sampled. 0 means all.
+
+	AdminAddr  string `toml:",omitempty"` // Address of the admin API, like "127.0.0.1:8546". Empty disables.
+	AdminToken string `toml:",omitempty"` // Bearer token required by the admin API. Required with AdminAddr.
+
+	Keys    []KeyConfig `toml:",omitempty"` // API keys, with their own limits and allow lists.
+	KeyFile string      `toml:",omitempty"` // TOML file with more Keys.
+
+	CacheSize         int64  `toml:",omitempty"` // Bytes of immutable results cached in memory. 0 disables.
+	CacheBlocksBehind uint64 `toml:",omitempty"` // Blocks behind the head before results for a block are cached. Default 64.
+
+	ReloadInterval time.Duration `toml:",omitempty"` // How often the config and key files are checked for changes. 0 disables, SIGHUP always reloads.
+
+	ClientVersion     string        `toml:",omitempty"` // Answer to web3_clientVersion, to hide the version of the upstreams. Empty uses theirs.
+	BlockNumberMaxAge time.Duration `toml:",omitempty"` // Answer eth_blockNumber from the tracked head while it is younger than this. 0 forwards it.
 }
 
 func main() {
@@ -85,7 +149,7 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:        "nolimit, n",
-			Usage:       "list of ips allowed unlimited requests(separated by commas)",
+			Usage:       "list of ips or cidrs allowed unlimited requests(separated by commas)",
 			Destination: &noLimitIPs,
 		},
 		&cli.Uint64Flag{
@@ -95,62 +159,73 @@ func main() {
 		},
 	}
 
-	app.Action = func(c *cli.Context) error {
+	// load reads the config file, and merges the flags into it.
+	load := func() (*ConfigData, error) {
 		var cfg ConfigData
 		if configPath != "" {
 			t, err := toml.LoadFile(configPath)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if err := t.Unmarshal(&cfg); err != nil {
-				return err
+				return nil, err
 			}
 		}
 
 		if port != "" {
 			if cfg.Port != "" {
-				return errors.New("port set in two places")
+				return nil, errors.New("port set in two places")
 			}
 			cfg.Port = port
 		}
 		if redirecturl != "" {
 			if cfg.URL != "" {
-				return errors.New("url set in two places")
+				return nil, errors.New("url set in two places")
 			}
 			cfg.URL = redirecturl
 		}
 		if redirectWSUrl != "" {
 			if cfg.WSURL != "" {
-				return errors.New("ws url set in two places")
+				return nil, errors.New("ws url set in two places")
 			}
 			cfg.WSURL = redirectWSUrl
 		}
 		if requestsPerMinuteLimit != 0 {
 			if cfg.RPM != 0 {
-				return errors.New("rpm set in two places")
+				return nil, errors.New("rpm set in two places")
 			}
 			cfg.RPM = requestsPerMinuteLimit
 		}
 		if allowedPaths != "" {
 			if len(cfg.Allow) > 0 {
-				return errors.New("allow set in two places")
+				return nil, errors.New("allow set in two places")
 			}
 			cfg.Allow = strings.Split(allowedPaths, ",")
 		}
 		if noLimitIPs != "" {
 			if len(cfg.NoLimit) > 0 {
-				return errors.New("nolimit set in two places")
+				return nil, errors.New("nolimit set in two places")
 			}
 			cfg.NoLimit = strings.Split(noLimitIPs, ",")
 		}
 		if blockRangeLimit > 0 {
 			if cfg.BlockRangeLimit > 0 {
-				return errors.New("block range limit set in two places")
+				return nil, errors.New("block range limit set in two places")
 			}
 			cfg.BlockRangeLimit = blockRangeLimit
 		}
+		sort.Strings(cfg.Allow)
+		sort.Strings(cfg.NoLimit)
 
-		return cfg.run(ctx)
+		return &cfg, nil
+	}
+
+	app.Action = func(c *cli.Context) error {
+		cfg, err := load()
+		if err != nil {
+			return err
+		}
+		return cfg.run(ctx, configPath, load)
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -160,13 +235,19 @@ func main() {
 	gotils.L(ctx).Info().Print("Shutting down")
 }
 
-func (cfg *ConfigData) run(ctx context.Context) error {
-	sort.Strings(cfg.Allow)
-	sort.Strings(cfg.NoLimit)
-
+// run serves the proxy. The config is reloaded from load, which reads the file
+// at configPath, on SIGHUP or when the file changes.
+func (cfg *ConfigData) run(ctx context.Context, configPath string, load func() (*ConfigData, error)) error {
 	gotils.L(ctx).Info().Println("Server starting, port:", cfg.Port, "redirectURL:", cfg.URL, "redirectWSURL:", cfg.WSURL,
+		"upstreams:", len(cfg.Upstreams), "balance:", cfg.Balance,
 		"rpmLimit:", cfg.RPM, "exempt:", cfg.NoLimit, "allowed:", cfg.Allow)
 
+	shutdownTracing, err := setupTracing(ctx, cfg.OTLPEndpoint, cfg.TraceSample)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
 	// Create proxy server.
 	server, err := cfg.NewServer()
 	if err != nil {
@@ -175,6 +256,7 @@ func (cfg *ConfigData) run(ctx context.Context) error {
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
+	r.Use(traceRequests)
 	r.Use(middleware.Recoverer)
 	// Use default options
 	r.Use(cors.New(cors.Options{
@@ -202,7 +284,33 @@ func (cfg *ConfigData) run(ctx context.Context) error {
 		}
 		w.WriteHeader(http.StatusOK)
 	})
+	go server.latestBlock.poll(ctx)
+	go server.latestBlock.subscribe(ctx)
+	go server.limiters.janitor(ctx)
+	go server.abuse.janitor(ctx)
+	go server.watchConfig(ctx, cfg, configPath, cfg.ReloadInterval, load)
+	if cfg.AdminAddr != "" {
+		if cfg.AdminToken == "" {
+			return errors.New("admin token is required with an admin address")
+		}
+		go func() {
+			if err := http.ListenAndServe(cfg.AdminAddr, server.adminRouter(cfg.AdminToken)); err != nil {
+				gotils.L(ctx).Error().Printf("Admin API stopped: %v", err)
+			}
+		}()
+	}
+
 	r.HandleFunc("/*", server.RPCProxy)
 	r.HandleFunc("/ws", server.WSProxy)
-	return http.ListenAndServe(":"+cfg.Port, r)
+	r.HandleFunc("/v1/{key}", server.RPCProxy)
+	r.HandleFunc("/v1/{key}/ws", server.WSProxy)
+
+	ln, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil {
+		return err
+	}
+	if cfg.ProxyProtocol {
+		ln = &proxyproto.Listener{Listener: ln, Policy: server.trustedProxies.proxyProtocolPolicy}
+	}
+	return http.Serve(ln, r)
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons for rejecting requests.
+const (
+	rejectRateLimit    = "rate_limit"
+	rejectUnauthorized = "unauthorized"
+	rejectBlockRange   = "block_range"
+	rejectInvalid      = "invalid"
+	rejectRequestLimit = "request_limit"
+	rejectDenied       = "denied"
+	rejectBanned       = "banned"
+	rejectAPIKey       = "api_key"
+)
+
+// otherMethod replaces methods outside of the allow list in labels, so callers
+// can't create unbounded numbers of series.
+const otherMethod = "other"
+
+// methodSet is a set of method names.
+type methodSet map[string]struct{}
+
+// literalMethod returns the method matched exactly by an allow rule, like
+// "eth_call" or "^eth_call$", or false if the rule is a pattern.
+func literalMethod(rule string) (string, bool) {
+	name := strings.TrimSuffix(strings.TrimPrefix(rule, "^"), "$")
+	return name, name != "" && regexp.QuoteMeta(name) == name
+}
+
+// labeledMethods returns the allowed methods which get their own label. Since
+// allow rules are unanchored patterns, only known methods and those named by
+// rules are labeled.
+func labeledMethods(allowed matcher, rules []string) methodSet {
+	var names []string
+	for m := range blockParamIndex {
+		names = append(names, m)
+	}
+	for m := range cacheRules {
+		names = append(names, m)
+	}
+	names = append(names, staticMethods...)
+	for _, rule := range append(defaultRetryMethods[:len(defaultRetryMethods):len(defaultRetryMethods)], rules...) {
+		if m, ok := literalMethod(rule); ok {
+			names = append(names, m)
+		}
+	}
+	set := make(methodSet)
+	for _, m := range names {
+		if allowed.MatchAnyRule(m) {
+			set[m] = struct{}{}
+		}
+	}
+	return set
+}
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests          *prometheus.CounterVec
+	rejections        *prometheus.CounterVec
+	upstreamDuration  *prometheus.HistogramVec
+	batchSize         prometheus.Histogram
+	wsConnections     prometheus.Gauge
+	cacheLookups      *prometheus.CounterVec
+	reorgs            prometheus.Counter
+	coalescedRequests prometheus.Counter
+}
+
+func newMetrics(t *myTransport) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rpc_proxy_requests_total",
+			Help: "JSON-RPC requests, by method and HTTP status.",
+		}, []string{"method", "status"}),
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rpc_proxy_rejections_total",
+			Help: "Requests rejected by the proxy, by reason.",
+		}, []string{"reason"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rpc_proxy_upstream_duration_seconds",
+			Help:    "Time until upstream response headers, by pool and upstream host.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"pool", "upstream"}),
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "rpc_proxy_batch_size",
+			Help:    "Number of requests in batches.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		wsConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "rpc_proxy_websocket_connections",
+			Help: "Active websocket connections.",
+		}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rpc_proxy_cache_lookups_total",
+			Help: "Lookups of cacheable requests in the response cache, by result.",
+		}, []string{"result"}),
+		reorgs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rpc_proxy_reorgs_total",
+			Help: "Chain reorganizations seen by the new heads subscription.",
+		}),
+		coalescedRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rpc_proxy_coalesced_requests_total",
+			Help: "Requests answered with the upstream response of an identical request in flight.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.rejections, m.upstreamDuration, m.batchSize, m.wsConnections, m.cacheLookups, m.reorgs, m.coalescedRequests,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rpc_proxy_latest_block",
+			Help: "Best head among the upstreams.",
+		}, func() float64 {
+			num, _ := t.latestBlock.head()
+			return float64(num)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rpc_proxy_latest_block_age_seconds",
+			Help: "Time since the latest block was updated.",
+		}, func() float64 {
+			_, at := t.latestBlock.head()
+			if at.IsZero() {
+				return 0
+			}
+			return time.Since(at).Seconds()
+		}),
+	)
+	if ms, ok := t.limiters.store.(*memoryStore); ok {
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rpc_proxy_visitors",
+			Help: "Visitors tracked by the rate limiter.",
+		}, func() float64 {
+			return float64(ms.size())
+		}))
+	}
+	if c := t.cache; c != nil {
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "rpc_proxy_cache_bytes",
+			Help: "Size of the cached results.",
+		}, func() float64 {
+			return float64(c.size())
+		}))
+	}
+	return m
+}
+
+// handler serves the metrics in the Prometheus format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// rejected counts a request rejected for reason.
+func (m *metrics) rejected(reason string) {
+	if m == nil {
+		return
+	}
+	m.rejections.WithLabelValues(reason).Inc()
+}
+
+// observeRequests counts requests for methods answered with httpCode.
+func (m *metrics) observeRequests(methods []string, httpCode int, labeled methodSet, batch bool) {
+	if m == nil {
+		return
+	}
+	if batch {
+		m.batchSize.Observe(float64(len(methods)))
+	}
+	status := strconv.Itoa(httpCode)
+	for _, method := range methods {
+		if _, ok := labeled[method]; !ok {
+			method = otherMethod
+		}
+		m.requests.WithLabelValues(method, status).Inc()
+	}
+}
+
+// observeUpstream records the time since start of a request to up.
+func (m *metrics) observeUpstream(up *upstream, pool string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.upstreamDuration.WithLabelValues(pool, up.url.Host).Observe(time.Since(start).Seconds())
+}
+
+// cacheLookup counts a lookup in the response cache.
+func (m *metrics) cacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(result).Inc()
+}
+
+// reorg counts a chain reorganization.
+func (m *metrics) reorg() {
+	if m == nil {
+		return
+	}
+	m.reorgs.Inc()
+}
+
+// coalesced counts a request which shared the response of another.
+func (m *metrics) coalesced() {
+	if m == nil {
+		return
+	}
+	m.coalescedRequests.Inc()
+}
+
+// wsConnected tracks an active websocket connection until the returned func is called.
+func (m *metrics) wsConnected() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.wsConnections.Inc()
+	return m.wsConnections.Dec
+}
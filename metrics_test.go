@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	node := newFakeNode(t, map[string]interface{}{"eth_call": "0x1"})
+	s := testServer(t, ConfigData{URL: node.URL, Allow: []string{"eth_call"}})
+
+	postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)
+	postRPC(s, `[{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]},{"jsonrpc":"2.0","id":2,"method":"eth_call","params":[]}]`)
+	postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"made_up","params":[]}`)
+	postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_callXYZ123","params":[]}`) // Allowed, but unknown.
+
+	w := httptest.NewRecorder()
+	s.adminRouter("").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, exp := range []string{
+		`rpc_proxy_requests_total{method="eth_call",status="200"} 3`,
+		`rpc_proxy_requests_total{method="other",status="405"} 1`,
+		`rpc_proxy_requests_total{method="other",status="200"} 1`,
+		`rpc_proxy_rejections_total{reason="unauthorized"} 1`,
+		`rpc_proxy_batch_size_count 1`,
+		`rpc_proxy_upstream_duration_seconds_count{pool="default",upstream="` + strings.TrimPrefix(node.URL, "http://") + `"} 3`,
+		`rpc_proxy_visitors 1`,
+		`rpc_proxy_websocket_connections 0`,
+		`rpc_proxy_latest_block `,
+	} {
+		if !strings.Contains(body, exp) {
+			t.Errorf("expected metrics to contain %q", exp)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -10,49 +11,92 @@ import (
 	"math/big"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"sort"
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gochain/gochain/v3/common"
 	"github.com/treeder/gotils/v2"
-	"golang.org/x/time/rate"
 )
 
 type Server struct {
-	target  *url.URL
 	proxy   *httputil.ReverseProxy
 	wsProxy *WebsocketProxy
 	myTransport
-	homepage []byte
 }
 
 func (cfg *ConfigData) NewServer() (*Server, error) {
-	url, err := url.Parse(cfg.URL)
+	s := &Server{
+		// The transport chooses the upstream and rewrites the URL for each request.
+		proxy: &httputil.ReverseProxy{Director: func(req *http.Request) {
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set("User-Agent", "")
+			}
+		}},
+	}
+	s.wsProxy = NewProxy(func() *upstreams { return s.settings().upstreams })
+	s.myTransport.transport = http.DefaultTransport
+	if cfg.UpstreamTimeout > 0 {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.ResponseHeaderTimeout = cfg.UpstreamTimeout
+		s.myTransport.transport = tr
+	}
+	s.myTransport.latestBlock.interval = cfg.HealthInterval
+	if s.myTransport.latestBlock.interval <= 0 {
+		s.myTransport.latestBlock.interval = defaultHealthInterval
+	}
+	var err error
+	if cfg.RedisURL != "" {
+		s.limiters.store, err = newRedisStore(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		visitorTTL := cfg.VisitorTTL
+		if visitorTTL <= 0 {
+			visitorTTL = defaultVisitorTTL
+		}
+		s.limiters.store = newMemoryStore(visitorTTL)
+	}
+	s.trustedProxies, err = parseIPNets(cfg.TrustedProxies)
 	if err != nil {
 		return nil, err
 	}
-	wsurl, err := url.Parse(cfg.WSURL)
-	if err != nil {
+	if cfg.ProxyProtocol && len(s.trustedProxies) == 0 {
+		return nil, fmt.Errorf("ProxyProtocol requires TrustedProxies")
+	}
+	s.ipv4Prefix = cfg.IPv4Prefix
+	if s.ipv4Prefix == 0 {
+		s.ipv4Prefix = defaultIPv4Prefix
+	}
+	s.ipv6Prefix = cfg.IPv6Prefix
+	if s.ipv6Prefix == 0 {
+		s.ipv6Prefix = defaultIPv6Prefix
+	}
+	s.abuse = newAbuseDetector(cfg)
+	s.cache = newResponseCache(cfg.CacheSize, cfg.CacheBlocksBehind)
+	s.latestBlock.heads.onReorg = func(ctx context.Context, fork uint64) {
+		n := s.cache.invalidate(fork)
+		s.metrics.reorg()
+		gotils.L(ctx).Info().Printf("Chain reorganized from block %d, invalidated %d cached results", fork, n)
+	}
+	if err := s.reload(cfg); err != nil {
 		return nil, err
 	}
-	s := &Server{target: url, proxy: httputil.NewSingleHostReverseProxy(url), wsProxy: NewProxy(wsurl)}
-	s.myTransport.blockRangeLimit = cfg.BlockRangeLimit
-	s.myTransport.url = cfg.URL
-	s.matcher, err = newMatcher(cfg.Allow)
+	s.metrics = newMetrics(&s.myTransport)
+	s.accessLog, err = newAccessLog(cfg.AccessLog, cfg.AccessLogSample)
 	if err != nil {
 		return nil, err
 	}
-	s.visitors = make(map[string]*rate.Limiter)
-	s.noLimitIPs = make(map[string]struct{})
-	for _, ip := range cfg.NoLimit {
-		s.noLimitIPs[ip] = struct{}{}
-	}
 	s.proxy.Transport = &s.myTransport
 	s.wsProxy.Transport = &s.myTransport
 
-	// Generate static home page.
+	return s, nil
+}
+
+// newHomePage renders the static home page.
+func newHomePage(rpm int, methods []string) ([]byte, error) {
 	id := json.RawMessage([]byte(`"ID"`))
 	responseRateLimit, err := json.MarshalIndent(jsonRPCLimit(id), "", "  ")
 	if err != nil {
@@ -64,8 +108,8 @@ func (cfg *ConfigData) NewServer() (*Server, error) {
 	}
 
 	data := &homePageData{
-		Limit:                requestsPerMinuteLimit,
-		Methods:              cfg.Allow,
+		Limit:                rpm,
+		Methods:              append([]string(nil), methods...),
 		ResponseRateLimit:    string(responseRateLimit),
 		ResponseUnauthorized: string(responseUnauthorized),
 	}
@@ -75,14 +119,12 @@ func (cfg *ConfigData) NewServer() (*Server, error) {
 	if err := homePageTmpl.Execute(&buf, &data); err != nil {
 		return nil, err
 	}
-	s.homepage = buf.Bytes()
-
-	return s, nil
+	return buf.Bytes(), nil
 }
 
 func (p *Server) HomePage(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	if _, err := io.Copy(w, bytes.NewReader(p.homepage)); err != nil {
+	if _, err := io.Copy(w, bytes.NewReader(p.settings().homepage)); err != nil {
 		gotils.L(ctx).Error().Printf("Failed to serve homepage: %v", err)
 		return
 	}
@@ -90,14 +132,63 @@ func (p *Server) HomePage(w http.ResponseWriter, r *http.Request) {
 
 func (p *Server) RPCProxy(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-rpc-proxy", "rpc-proxy")
+	r, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
 	p.proxy.ServeHTTP(w, r)
 }
 
 func (p *Server) WSProxy(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-rpc-proxy", "rpc-proxy")
+	r, ok := p.authenticate(w, r)
+	if !ok {
+		return
+	}
+	// Refuse denied and banned visitors before connecting to an upstream.
+	ip := p.getIP(r)
+	if p.denied(ip) {
+		gotils.L(r.Context()).Info().Print("Request blocked: IP denied")
+		p.metrics.rejected(rejectDenied)
+		writeJSONRPC(w, r, http.StatusForbidden, jsonRPCDenied(json.RawMessage("null")))
+		return
+	}
+	id, _ := p.visitorID(ModifiedRequest{RemoteAddr: ip, Key: apiKeyFrom(r.Context())})
+	if until, ok := p.abuse.banned(id); ok {
+		gotils.L(r.Context()).Info().Print("Request blocked: Banned")
+		p.metrics.rejected(rejectBanned)
+		writeJSONRPC(w, r, http.StatusForbidden, jsonRPCBan(json.RawMessage("null"), until))
+		return
+	}
 	p.wsProxy.ServeHTTP(w, r)
 }
 
+// authenticate returns r with its API key attached, or writes an error
+// response and returns false if the key is rejected.
+func (p *Server) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	r2, code, err := p.settings().keys.authenticate(r, p.getIP(r))
+	if err == nil {
+		return r2, true
+	}
+	gotils.L(r.Context()).Info().Printf("Request blocked: %v", err)
+	p.metrics.rejected(rejectAPIKey)
+	writeJSONRPC(w, r, code, jsonRPCError(json.RawMessage("null"), jsonRPCInvalidRequest, err.Error()))
+	return nil, false
+}
+
+// writeJSONRPC writes a JSON-RPC response with status code.
+func writeJSONRPC(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		gotils.L(r.Context()).Error().Printf("Failed to construct a response: %v", err)
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
 func (p *Server) Example(w http.ResponseWriter, r *http.Request) {
 	method := chi.URLParam(r, "method")
 	args := []string{
@@ -299,17 +390,33 @@ func (p *Server) example(method string, params ...interface{}) ([]byte, error) {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, p.target.String(), bytes.NewReader(body))
+	_, parsed, err := parseMessage(body, "", requestLimits{})
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if responses := make([]json.RawMessage, 1); p.fromStatic(ctx, parsed, responses) > 0 {
+		return exampleResponse(method, body, indent(responses[0]))
+	}
+	pool, _ := p.poolFor(ctx, parsed)
+	up := pool.pick()
+	if up == nil {
+		return nil, errNoUpstream
+	}
+	req, err := http.NewRequest(http.MethodPost, up.url.String(), bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	const contentType = "application/json"
 	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("Accept", contentType)
-	resp, err := http.DefaultClient.Do(req)
+	up.acquire()
+	resp, err := up.trackResponse(http.DefaultClient.Do(req))
+	up.report(req.Context(), err == nil && resp.StatusCode < 500)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -322,8 +429,12 @@ func (p *Server) example(method string, params ...interface{}) ([]byte, error) {
 		formattedResp = indent(respBody)
 	}
 
+	return exampleResponse(method, body, formattedResp)
+}
+
+func exampleResponse(method string, body []byte, response string) ([]byte, error) {
 	var buf bytes.Buffer
-	if err := exampleTmpl.Execute(&buf, &exampleData{Method: method, Request: indent(body), Response: formattedResp}); err != nil {
+	if err := exampleTmpl.Execute(&buf, &exampleData{Method: method, Request: indent(body), Response: response}); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisKeyPrefix = "rpc-proxy:limit:"
+
+// gcraScript implements the generic cell rate algorithm, which behaves like a
+// token bucket while storing a single timestamp per visitor: the theoretical
+// arrival time (TAT) of the next request, in milliseconds. Requests are
+// allowed as long as the TAT stays within burst intervals of now. Keys expire
+// once the bucket would be full again.
+var gcraScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local added = 0
+local tat = redis.call('GET', KEYS[1])
+if tat then
+	tat = tonumber(tat)
+else
+	tat = now
+	added = 1
+end
+if tat < now then
+	tat = now
+end
+local next = tat + n * interval
+if next - now > burst * interval then
+	return {0, added}
+end
+redis.call('SET', KEYS[1], string.format('%.3f', next), 'PX', math.ceil(next - now) + 1)
+return {1, added}
+`)
+
+// redisStore is a limiterStore shared by every proxy using the same Redis.
+type redisStore struct {
+	client redis.UniversalClient
+}
+
+func newRedisStore(url string) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %v", err)
+	}
+	return &redisStore{client: redis.NewClient(opts)}, nil
+}
+
+func (s *redisStore) allow(ctx context.Context, id string, rpm, burst, n int) (bool, bool, error) {
+	now := float64(time.Now().UnixNano()) / float64(time.Millisecond)
+	interval := float64(time.Minute/time.Millisecond) / float64(rpm)
+	res, err := gcraScript.Run(ctx, s.client, []string{redisKeyPrefix + id}, now, interval, burst, n).Int64Slice()
+	if err != nil {
+		return false, false, fmt.Errorf("redis: %v", err)
+	}
+	if len(res) != 2 {
+		return false, false, fmt.Errorf("redis: unexpected result: %v", res)
+	}
+	return res[0] == 1, res[1] == 1, nil
+}
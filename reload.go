@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/treeder/gotils/v2"
+)
+
+// settings are the parts of the config which can be reloaded without a
+// restart. They are replaced as a whole, so requests in flight finish with
+// the pools they already chose, and open websockets keep their upstream.
+type settings struct {
+	blockRangeLimit uint64 // 0 means none
+
+	upstreams *upstreams // The default pool.
+	pools     map[string]*upstreams
+	poolList  []*upstreams // Every pool, the default first.
+	routes    []route
+
+	retries      int
+	retryMethods matcher
+
+	maxUpstreamBatch int // 0 means none
+
+	costs costs
+
+	requestLimits
+
+	matcher
+	labeled methodSet // Allowed methods with their own metrics label.
+	keys    apiKeys
+
+	clientVersion     json.RawMessage // Answer to web3_clientVersion, nil to use the upstream's.
+	blockNumberMaxAge time.Duration   // 0 forwards eth_blockNumber.
+
+	homepage []byte
+}
+
+// settings returns the current settings.
+func (t *myTransport) settings() *settings {
+	return t.current.Load()
+}
+
+// newSettings validates the reloadable parts of cfg. Upstreams unchanged from
+// old keep their health and circuit breaker.
+func (cfg *ConfigData) newSettings(old *settings) (*settings, error) {
+	ups, pools, routes, err := cfg.newPools()
+	if err != nil {
+		return nil, err
+	}
+	st := &settings{
+		blockRangeLimit:   cfg.BlockRangeLimit,
+		upstreams:         ups,
+		pools:             pools,
+		poolList:          []*upstreams{ups},
+		routes:            routes,
+		retries:           cfg.Retries,
+		blockNumberMaxAge: cfg.BlockNumberMaxAge,
+		maxUpstreamBatch:  cfg.MaxUpstreamBatch,
+		requestLimits: requestLimits{
+			maxBodyBytes: cfg.MaxBodyBytes,
+			maxBatchSize: cfg.MaxBatchSize,
+			maxJSONDepth: cfg.MaxJSONDepth,
+		},
+	}
+	for _, p := range cfg.Pools {
+		st.poolList = append(st.poolList, pools[p.Name])
+	}
+	if cfg.ClientVersion != "" {
+		st.clientVersion = mustMarshal(cfg.ClientVersion)
+	}
+	if old != nil {
+		for name, pool := range pools {
+			if o, ok := old.pools[name]; ok {
+				pool.adopt(o)
+			}
+		}
+	}
+	if st.retries == 0 {
+		st.retries = defaultRetries
+	}
+	retryMethods := cfg.RetryMethods
+	if len(retryMethods) == 0 {
+		retryMethods = defaultRetryMethods
+	}
+	st.retryMethods, err = newMatcher(retryMethods)
+	if err != nil {
+		return nil, err
+	}
+	st.costs, err = newCosts(cfg.Costs)
+	if err != nil {
+		return nil, err
+	}
+	st.matcher, err = newMatcher(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	st.labeled = labeledMethods(st.matcher, cfg.Allow)
+	st.keys, err = newAPIKeys(cfg.Keys, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	rpm := cfg.RPM
+	if rpm <= 0 {
+		rpm = requestsPerMinuteLimit
+	}
+	st.homepage, err = newHomePage(rpm, cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// adopt carries the health and circuit breaker of upstreams which are
+// unchanged from old over to us.
+func (us *upstreams) adopt(old *upstreams) {
+	for _, u := range us.list {
+		for _, o := range old.list {
+			if o.String() == u.String() && sameURL(o.wsURL, u.wsURL) && o.weight == u.weight {
+				atomic.StoreInt32(&u.unhealthy, atomic.LoadInt32(&o.unhealthy))
+				atomic.StoreUint64(&u.head, atomic.LoadUint64(&o.head))
+				u.breaker = o.breaker
+				u.static.Store(o.static.Load())
+				break
+			}
+		}
+	}
+}
+
+func sameURL(a, b *url.URL) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+// reload validates cfg, and then swaps in its settings and limits. Changes
+// made through the admin API are replaced.
+func (p *Server) reload(cfg *ConfigData) error {
+	st, err := cfg.newSettings(p.settings())
+	if err != nil {
+		return err
+	}
+	noLimit, err := parseIPNets(cfg.NoLimit)
+	if err != nil {
+		return err
+	}
+	deny, err := parseIPNets(cfg.Deny)
+	if err != nil {
+		return err
+	}
+	p.current.Store(st)
+	p.latestBlock.setPools(st.poolList)
+	p.setLists(noLimit, deny)
+	if cfg.RPM > 0 {
+		p.setRPM(cfg.RPM)
+	}
+	return nil
+}
+
+// restartOnly returns a copy of cfg without the fields which can be reloaded.
+func (cfg ConfigData) restartOnly() ConfigData {
+	cfg.URL, cfg.WSURL, cfg.Upstreams, cfg.Balance, cfg.Pools, cfg.Routes = "", "", nil, "", nil, nil
+	cfg.Allow, cfg.RPM, cfg.NoLimit, cfg.Deny, cfg.BlockRangeLimit, cfg.Costs = nil, 0, nil, nil, 0, nil
+	cfg.Retries, cfg.RetryMethods, cfg.MaxUpstreamBatch = 0, nil, 0
+	cfg.MaxBodyBytes, cfg.MaxBatchSize, cfg.MaxJSONDepth = 0, 0, 0
+	cfg.Keys, cfg.KeyFile, cfg.ClientVersion, cfg.BlockNumberMaxAge = nil, "", "", 0
+	return cfg
+}
+
+// watchConfig reloads the config with load on SIGHUP, and whenever the config
+// or key file changes if interval is set, until ctx is done.
+func (p *Server) watchConfig(ctx context.Context, cfg *ConfigData, path string, interval time.Duration, load func() (*ConfigData, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	running := cfg.restartOnly()
+	files := modTimes(path, cfg.KeyFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			gotils.L(ctx).Info().Print("Reloading config on SIGHUP")
+		case <-tick:
+			changed := modTimes(path, cfg.KeyFile)
+			if reflect.DeepEqual(changed, files) {
+				continue
+			}
+			files = changed
+			gotils.L(ctx).Info().Print("Reloading config after a file changed")
+		}
+		newCfg, err := load()
+		if err == nil {
+			err = p.reload(newCfg)
+		}
+		if err != nil {
+			gotils.L(ctx).Error().Printf("Failed to reload config, keeping the old one: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(running, newCfg.restartOnly()) {
+			gotils.L(ctx).Error().Print("Some config changes require a restart to take effect")
+		}
+		gotils.L(ctx).Info().Println("Reloaded config, upstreams:", len(newCfg.Upstreams), "rpmLimit:", newCfg.RPM,
+			"exempt:", newCfg.NoLimit, "allowed:", newCfg.Allow)
+		cfg = newCfg
+		files = modTimes(path, cfg.KeyFile)
+	}
+}
+
+// modTimes returns the modification times of paths which exist.
+func modTimes(paths ...string) map[string]time.Time {
+	m := make(map[string]time.Time)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			m[path] = fi.ModTime()
+		}
+	}
+	return m
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+)
+
+func TestReload(t *testing.T) {
+	a := newFakeNode(t, map[string]interface{}{"eth_call": "0x1", "eth_blockNumber": "0x1"})
+	b := newFakeNode(t, map[string]interface{}{"eth_call": "0x2", "eth_blockNumber": "0x2"})
+	s := testServer(t, ConfigData{Upstreams: []UpstreamConfig{{URL: a.URL}, {URL: b.URL}}, Allow: []string{"eth_call"}})
+	const blockNumber = `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`
+	if w := postRPC(s, blockNumber); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected method to be disallowed but got %d", w.Code)
+	}
+	old := s.settings().upstreams.list[1]
+	old.setHealthy(context.Background(), false, "test")
+
+	if err := s.reload(&ConfigData{Upstreams: []UpstreamConfig{{URL: b.URL}}, Pools: []PoolConfig{{Name: "x"}}}); err == nil {
+		t.Fatal("expected invalid config to be refused")
+	}
+	if err := s.reload(&ConfigData{Upstreams: []UpstreamConfig{{URL: b.URL}}, Allow: []string{"eth_call", "eth_blockNumber"}}); err != nil {
+		t.Fatal(err)
+	}
+	if up := s.settings().upstreams.list[0]; up.available() {
+		t.Error("expected unchanged upstream to stay unhealthy")
+	}
+	if pools := s.latestBlock.getPools(); len(pools) != 1 || pools[0] != s.settings().upstreams {
+		t.Error("expected health checks to use the new pools")
+	}
+	if w := postRPC(s, blockNumber); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "0x2") {
+		t.Fatalf("expected method to be allowed from the new upstream but got %d: %s", w.Code, w.Body)
+	}
+	if a.called("eth_blockNumber") > 0 {
+		t.Error("expected removed upstream to get no requests")
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	node := newFakeNode(t, map[string]interface{}{"eth_call": "0x1"})
+	path := filepath.Join(t.TempDir(), "config.toml")
+	write := func(cfg ConfigData, mod time.Time) {
+		b, err := toml.Marshal(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func() (*ConfigData, error) {
+		tree, err := toml.LoadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var cfg ConfigData
+		return &cfg, tree.Unmarshal(&cfg)
+	}
+	cfg := ConfigData{URL: node.URL, Allow: []string{"eth_call"}}
+	write(cfg, time.Now().Add(-time.Hour))
+	s := testServer(t, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	running := cfg
+	go s.watchConfig(ctx, &running, path, 10*time.Millisecond, load)
+
+	cfg.BlockRangeLimit = 100
+	// The watcher may start after any single write, so keep changing the file.
+	for i := 0; s.settings().blockRangeLimit != 100; i++ {
+		if i == 500 {
+			t.Fatal("expected config to be reloaded after the file changed")
+		}
+		write(cfg, time.Now().Add(time.Duration(i)*time.Second))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
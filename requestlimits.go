@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+const jsonRPCInvalidRequest = -32600
+
+// requestLimits bound the size and shape of incoming messages. 0 means none.
+type requestLimits struct {
+	maxBodyBytes int64
+	maxBatchSize int
+	maxJSONDepth int
+}
+
+// limitError is returned when a message exceeds one of the requestLimits.
+type limitError struct {
+	httpCode int
+	msg      string
+}
+
+func (e *limitError) Error() string { return e.msg }
+
+// response returns a JSON-RPC error response for the limit violation.
+func (e *limitError) response() interface{} {
+	return jsonRPCError(json.RawMessage("null"), jsonRPCInvalidRequest, e.msg)
+}
+
+// readBody reads the body of r, up to maxBodyBytes.
+func (l requestLimits) readBody(r *http.Request) ([]byte, error) {
+	if l.maxBodyBytes <= 0 {
+		return ioutil.ReadAll(r.Body)
+	}
+	if r.ContentLength > l.maxBodyBytes {
+		return nil, l.bodyError()
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, l.maxBodyBytes+1))
+	if err != nil {
+		return body, err
+	}
+	if int64(len(body)) > l.maxBodyBytes {
+		return nil, l.bodyError()
+	}
+	return body, nil
+}
+
+// readMessage reads the next message from c, up to maxBodyBytes. The rest of
+// a larger message is discarded, so the connection can be kept.
+func (l requestLimits) readMessage(c *websocket.Conn) (int, []byte, error) {
+	msgType, r, err := c.NextReader()
+	if err != nil {
+		return msgType, nil, err
+	}
+	if l.maxBodyBytes <= 0 {
+		msg, err := ioutil.ReadAll(r)
+		return msgType, msg, err
+	}
+	msg, err := ioutil.ReadAll(io.LimitReader(r, l.maxBodyBytes+1))
+	if err != nil {
+		return msgType, nil, err
+	}
+	if int64(len(msg)) > l.maxBodyBytes {
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return msgType, nil, err
+		}
+		return msgType, nil, l.bodyError()
+	}
+	return msgType, msg, nil
+}
+
+func (l requestLimits) bodyError() error {
+	return &limitError{httpCode: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf("Request body is larger than limit (%d bytes)", l.maxBodyBytes)}
+}
+
+// checkDepth returns an error if the JSON in msg is nested deeper than maxJSONDepth.
+func (l requestLimits) checkDepth(msg []byte) error {
+	if l.maxJSONDepth <= 0 {
+		return nil
+	}
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range msg {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '[', '{':
+			depth++
+			if depth > l.maxJSONDepth {
+				return &limitError{httpCode: http.StatusBadRequest, msg: fmt.Sprintf("Request is nested deeper than limit (%d)", l.maxJSONDepth)}
+			}
+		case ']', '}':
+			depth--
+		}
+	}
+	return nil
+}
+
+// checkBatch returns an error if a batch has more than maxBatchSize elements.
+func (l requestLimits) checkBatch(size int) error {
+	if l.maxBatchSize > 0 && size > l.maxBatchSize {
+		return &limitError{httpCode: http.StatusBadRequest, msg: fmt.Sprintf("Batch size (%d) is larger than limit (%d)", size, l.maxBatchSize)}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRequestLimits_checkDepth(t *testing.T) {
+	l := requestLimits{maxJSONDepth: 3}
+	for _, tc := range []struct {
+		msg string
+		ok  bool
+	}{
+		{`{"params":[[1]]}`, true},
+		{`{"params":[[[1]]]}`, false},
+		{`{"params":["[[[[["]}`, true},
+		{`{"params":["\"[[[["]}`, true},
+		{`[{"params":[1]},{"params":[2]}]`, true},
+	} {
+		if err := l.checkDepth([]byte(tc.msg)); (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok %t but got error: %v", tc.msg, tc.ok, err)
+		}
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	node := newFakeNode(t, nodeResults("0x10"))
+	node.set("eth_chainId", "0x3c")
+	ws := newFakeWSNode(t, node)
+	s := testServer(t, ConfigData{
+		Upstreams:    []UpstreamConfig{{URL: node.URL, WSURL: "ws" + strings.TrimPrefix(ws.URL, "http")}},
+		Allow:        []string{"eth_chainId"},
+		MaxBodyBytes: 200,
+		MaxBatchSize: 2,
+	})
+
+	if w := postRPC(s, `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`); w.Code != http.StatusOK {
+		t.Errorf("expected batch within limits to succeed but got %d: %s", w.Code, w.Body)
+	}
+	w := postRPC(s, `[{"id":1,"method":"eth_chainId"},{"id":2,"method":"eth_chainId"},{"id":3,"method":"eth_chainId"}]`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "-32600") {
+		t.Errorf("expected large batch to be rejected but got %d: %s", w.Code, w.Body)
+	}
+	w = postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":["`+strings.Repeat("a", 200)+`"]}`)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected large body to be rejected but got %d: %s", w.Code, w.Body)
+	}
+
+	// Large websocket messages are answered with an error, and the connection is kept.
+	proxy := httptest.NewServer(http.HandlerFunc(s.WSProxy))
+	defer proxy.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, tc := range []struct {
+		msg, resp string
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":["` + strings.Repeat("a", 200) + `"]}`, "-32600"},
+		{`{"jsonrpc":"2.0","id":2,"method":"eth_chainId","params":[]}`, `"0x3c"`},
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(tc.msg)); err != nil {
+			t.Fatal(err)
+		}
+		_, resp, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(resp), tc.resp) {
+			t.Errorf("expected response with %s but got %s", tc.resp, resp)
+		}
+	}
+}
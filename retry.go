@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/treeder/gotils/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultRetries = 2
+
+// defaultRetryMethods are read-only methods which are safe to send to another upstream.
+var defaultRetryMethods = []string{
+	"^clique_",
+	"^eth_blockNumber$",
+	"^eth_call$",
+	"^eth_chainId$",
+	"^eth_estimateGas$",
+	"^eth_gasPrice$",
+	"^eth_genesisAlloc$",
+	"^eth_getBalance$",
+	"^eth_getBlockBy",
+	"^eth_getBlockTransactionCountBy",
+	"^eth_getCode$",
+	"^eth_getLogs$",
+	"^eth_getStorageAt$",
+	"^eth_getTransactionBy",
+	"^eth_getTransactionCount$",
+	"^eth_getTransactionReceipt$",
+	"^eth_totalSupply$",
+	"^net_listening$",
+	"^net_version$",
+	"^rpc_modules$",
+	"^web3_clientVersion$",
+}
+
+// neverRetry matches methods which have side effects or upstream state, and
+// must not be retried even if configured.
+var neverRetry = mustMatcher(
+	"^eth_sendRawTransaction$",
+	"^eth_sendTransaction$",
+	"Filter", // eth_newFilter, eth_getFilterChanges, eth_uninstallFilter, etc.
+	"^eth_(un)?subscribe$",
+)
+
+func mustMatcher(rules ...string) matcher {
+	m, err := newMatcher(rules)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// retryable returns true if every request may be safely sent to another upstream.
+func (t *myTransport) retryable(parsedRequests []ModifiedRequest) bool {
+	st := t.settings()
+	if st.retries <= 0 {
+		return false
+	}
+	for _, r := range parsedRequests {
+		if !st.retryMethods.MatchAnyRule(r.Path) || neverRetry.MatchAnyRule(r.Path) {
+			return false
+		}
+	}
+	return true
+}
+
+// forward sends req to an upstream from pool. Failed attempts are retried on other
+// upstreams when retry is set and the failure was a transport error or 5xx.
+func (t *myTransport) forward(ctx context.Context, req *http.Request, pool *upstreams, retry bool) (*http.Response, error) {
+	up := pool.pick()
+	if up == nil {
+		return nil, errNoUpstream
+	}
+	retries := t.settings().retries
+	var tried []*upstream
+	for attempt := 0; ; attempt++ {
+		tried = append(tried, up)
+		requestInfoFrom(ctx).addUpstream(up)
+		start := time.Now()
+		resp, err := t.send(ctx, req, up, attempt)
+		t.metrics.observeUpstream(up, pool.name, start)
+		// A client hanging up says nothing about the upstream.
+		if ctx.Err() == nil && req.Context().Err() == nil && !errors.Is(err, context.Canceled) {
+			up.report(ctx, err == nil && resp.StatusCode < 500)
+		}
+		if !retry || attempt >= retries || req.Context().Err() != nil || (err == nil && resp.StatusCode < 500) {
+			return resp, err
+		}
+		next := pool.pick(tried...)
+		if next == nil {
+			return resp, err
+		}
+		if err == nil {
+			err = errStatus(resp.StatusCode)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		gotils.L(ctx).Info().Printf("Retrying request, attempt: %d, failed upstream: %s, next upstream: %s, error: %v", attempt+1, up, next, err)
+		up = next
+	}
+}
+
+// send makes a single attempt of req against up.
+func (t *myTransport) send(ctx context.Context, req *http.Request, up *upstream, attempt int) (resp *http.Response, err error) {
+	ctx, span := tracer().Start(ctx, "upstream", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("upstream", up.url.Host), attribute.Int("attempt", attempt)))
+	defer func() {
+		spanErr := err
+		if err == nil {
+			span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+			if resp.StatusCode >= 500 {
+				spanErr = errStatus(resp.StatusCode)
+			}
+		}
+		endSpan(span, spanErr)
+	}()
+	outreq := req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(outreq.Header))
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		outreq.Body = body
+	}
+	outreq.URL = up.target(req.URL)
+	outreq.Host = req.RemoteAddr //workaround for CloudFlare
+	up.acquire()
+	return up.trackResponse(t.transport.RoundTrip(outreq))
+}
+
+type errStatus int
+
+func (e errStatus) Error() string {
+	return fmt.Sprintf("upstream responded with status %d %s", int(e), http.StatusText(int(e)))
+}
+
+// setBody replaces the body of r with one which can be read again by GetBody.
+func setBody(r *http.Request, body []byte) {
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
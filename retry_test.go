@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServer(t *testing.T, cfg ConfigData) *Server {
+	t.Helper()
+	requestsPerMinuteLimit = 1000
+	s, err := cfg.NewServer()
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	return s
+}
+
+func postRPC(s *Server, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.RPCProxy(w, req)
+	return w
+}
+
+func TestRetry(t *testing.T) {
+	bad := newFakeNode(t, map[string]interface{}{})
+	bad.fail(http.StatusBadGateway)
+	good := newFakeNode(t, map[string]interface{}{"eth_call": "0x1", "eth_sendRawTransaction": "0x2"})
+	s := testServer(t, ConfigData{
+		Upstreams: []UpstreamConfig{{URL: bad.URL}, {URL: good.URL}},
+		Allow:     []string{"eth_call", "eth_sendRawTransaction"},
+	})
+
+	for i := 0; i < 4; i++ {
+		w := postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected eth_call to be retried but got %d: %s", w.Code, w.Body)
+		}
+	}
+	if good.called("eth_call") != 4 {
+		t.Errorf("expected 4 calls to good upstream but got %d", good.called("eth_call"))
+	}
+
+	var failed int
+	for i := 0; i < 4; i++ {
+		w := postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0x00"]}`)
+		if w.Code == http.StatusBadGateway {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Errorf("expected 2 failed eth_sendRawTransaction calls but got %d", failed)
+	}
+	if good.called("eth_sendRawTransaction") != 2 {
+		t.Errorf("expected 2 calls to good upstream but got %d", good.called("eth_sendRawTransaction"))
+	}
+}
+
+func TestRetry_canceled(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body) // So the hang-up is noticed.
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	s := testServer(t, ConfigData{URL: slow.URL, Allow: []string{"eth_call", "eth_sendRawTransaction"}, BreakerFailures: 1})
+
+	// Shared and unshared requests.
+	for _, method := range []string{"eth_call", "eth_sendRawTransaction"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":[]}`)).WithContext(ctx)
+		s.RPCProxy(httptest.NewRecorder(), req)
+		cancel()
+	}
+	time.Sleep(20 * time.Millisecond) // Let the shared call finish.
+	if state := s.settings().upstreams.list[0].breaker.getState(); state != breakerClosed {
+		t.Errorf("expected client hang-ups not to open the circuit but got %s", state)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gochain/gochain/v3/rpc"
+)
+
+// defaultPool is the name of the pool made of the top level Upstreams (or URL and WSURL).
+const defaultPool = "default"
+
+// PoolConfig is a named set of upstreams which requests can be routed to.
+type PoolConfig struct {
+	Name      string           `toml:",omitempty"`
+	Balance   string           `toml:",omitempty"`
+	Upstreams []UpstreamConfig `toml:",omitempty"`
+}
+
+// RouteConfig sends requests for matching methods to a pool. Routes are
+// evaluated in order, and requests matching none go to the default pool.
+type RouteConfig struct {
+	Methods []string `toml:",omitempty"` // Regular expressions, like Allow.
+	Pool    string   `toml:",omitempty"`
+	// When set, the route only matches requests with a block number parameter
+	// at least this many blocks behind the head.
+	BlocksBehind uint64 `toml:",omitempty"`
+}
+
+type route struct {
+	matcher
+	pool         *upstreams
+	blocksBehind uint64
+}
+
+// blockParamIndex is the position of the block number parameter of methods which have one.
+var blockParamIndex = map[string]int{
+	"clique_getSigners":                       0,
+	"clique_getSnapshot":                      0,
+	"clique_getVoters":                        0,
+	"eth_call":                                1,
+	"eth_estimateGas":                         1,
+	"eth_getBalance":                          1,
+	"eth_getBlockByNumber":                    0,
+	"eth_getBlockTransactionCountByNumber":    0,
+	"eth_getCode":                             1,
+	"eth_getStorageAt":                        2,
+	"eth_getTransactionByBlockNumberAndIndex": 0,
+	"eth_getTransactionCount":                 1,
+	"eth_totalSupply":                         0,
+}
+
+// blockParam returns the block number requested by r, or false if it has none
+// or it is a tag like "latest".
+func blockParam(r ModifiedRequest) (uint64, bool) {
+	i, ok := blockParamIndex[r.Path]
+	if !ok || i >= len(r.Params) {
+		return 0, false
+	}
+	var num rpc.BlockNumber
+	if err := json.Unmarshal(r.Params[i], &num); err != nil || num < 0 {
+		return 0, false
+	}
+	return uint64(num), true
+}
+
+// newPool creates the upstreams for a pool, with the shared health and breaker settings.
+func (cfg *ConfigData) newPool(name string, upstreamCfgs []UpstreamConfig, balance string) (*upstreams, error) {
+	maxBlockLag := cfg.MaxBlockLag
+	if maxBlockLag == 0 {
+		maxBlockLag = defaultMaxBlockLag
+	}
+	ups, err := newUpstreams(upstreamCfgs, balance, maxBlockLag)
+	if err != nil {
+		return nil, fmt.Errorf("pool %s: %v", name, err)
+	}
+	ups.name = name
+	for _, u := range ups.list {
+		u.breaker = newBreaker(cfg)
+	}
+	return ups, nil
+}
+
+// newPools returns the default pool, all pools by name, and the routes between them.
+func (cfg *ConfigData) newPools() (*upstreams, map[string]*upstreams, []route, error) {
+	upstreamCfgs := cfg.Upstreams
+	if len(upstreamCfgs) == 0 {
+		upstreamCfgs = []UpstreamConfig{{URL: cfg.URL, WSURL: cfg.WSURL}}
+	}
+	def, err := cfg.newPool(defaultPool, upstreamCfgs, cfg.Balance)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pools := map[string]*upstreams{defaultPool: def}
+	for _, p := range cfg.Pools {
+		if p.Name == "" {
+			return nil, nil, nil, fmt.Errorf("pool name is required")
+		}
+		if _, ok := pools[p.Name]; ok {
+			return nil, nil, nil, fmt.Errorf("duplicate pool: %s", p.Name)
+		}
+		pools[p.Name], err = cfg.newPool(p.Name, p.Upstreams, p.Balance)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	var routes []route
+	for _, r := range cfg.Routes {
+		pool, ok := pools[r.Pool]
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("route to unknown pool: %q", r.Pool)
+		}
+		if len(r.Methods) == 0 {
+			return nil, nil, nil, fmt.Errorf("route to pool %s has no methods", r.Pool)
+		}
+		m, err := newMatcher(r.Methods)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		routes = append(routes, route{matcher: m, pool: pool, blocksBehind: r.BlocksBehind})
+	}
+	return def, pools, routes, nil
+}
+
+// route returns the pool which should serve r.
+func (t *myTransport) route(ctx context.Context, r ModifiedRequest) *upstreams {
+	st := t.settings()
+	for _, rt := range st.routes {
+		if !rt.MatchAnyRule(r.Path) {
+			continue
+		}
+		if rt.blocksBehind > 0 {
+			num, ok := blockParam(r)
+			if !ok {
+				continue
+			}
+			head, err := t.latestBlock.get(ctx)
+			if err != nil || num > head || head-num < rt.blocksBehind {
+				continue
+			}
+		}
+		return rt.pool
+	}
+	return st.upstreams
+}
+
+// poolFor returns the pool which should serve all of parsedRequests, or false
+// if they belong to different pools.
+func (t *myTransport) poolFor(ctx context.Context, parsedRequests []ModifiedRequest) (*upstreams, bool) {
+	if st := t.settings(); len(st.routes) == 0 {
+		return st.upstreams, true
+	}
+	var pool *upstreams
+	for _, r := range parsedRequests {
+		p := t.route(ctx, r)
+		if pool != nil && p != pool {
+			return nil, false
+		}
+		pool = p
+	}
+	return pool, true
+}
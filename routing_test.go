@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRouting(t *testing.T) {
+	full := newFakeNode(t, nodeResults("0x1000"))
+	archive := newFakeNode(t, nodeResults("0x1000"))
+	for _, n := range []*fakeNode{full, archive} {
+		n.set("eth_getBalance", "0x1")
+		n.set("debug_traceTransaction", map[string]string{})
+	}
+	s := testServer(t, ConfigData{
+		Upstreams: []UpstreamConfig{{URL: full.URL}},
+		Pools:     []PoolConfig{{Name: "archive", Upstreams: []UpstreamConfig{{URL: archive.URL}}}},
+		Routes: []RouteConfig{
+			{Methods: []string{"^debug_"}, Pool: "archive"},
+			{Methods: []string{"^eth_getBalance$"}, Pool: "archive", BlocksBehind: 128},
+		},
+		Allow: []string{"eth_getBalance", "debug_traceTransaction"},
+	})
+
+	for _, tc := range []struct {
+		body    string
+		archive bool
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"debug_traceTransaction","params":["0x00"]}`, true},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","latest"]}`, false},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","0xff0"]}`, false},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","0x10"]}`, true},
+		{`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000000","earliest"]}`, true},
+	} {
+		before := archive.called("eth_getBalance") + archive.called("debug_traceTransaction")
+		w := postRPC(s, tc.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+		}
+		after := archive.called("eth_getBalance") + archive.called("debug_traceTransaction")
+		if have := after > before; have != tc.archive {
+			t.Errorf("%s: expected archive %t but got %t", tc.body, tc.archive, have)
+		}
+	}
+}
+
+func TestRouting_invalid(t *testing.T) {
+	for _, cfg := range []ConfigData{
+		{URL: "http://a", Routes: []RouteConfig{{Methods: []string{"eth_call"}, Pool: "missing"}}},
+		{URL: "http://a", Pools: []PoolConfig{{Name: "default", Upstreams: []UpstreamConfig{{URL: "http://b"}}}}},
+		{URL: "http://a", Pools: []PoolConfig{{Name: "archive"}}},
+	} {
+		if _, _, _, err := cfg.newPools(); err == nil {
+			t.Errorf("expected error for config: %+v", cfg)
+		}
+	}
+}
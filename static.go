@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/gochain/gochain/v3/rpc"
+)
+
+// staticMethods never change for the lifetime of an upstream, so they are
+// answered by the proxy once learned.
+var staticMethods = []string{"eth_chainId", "net_version", "web3_clientVersion", "rpc_modules", "net_listening"}
+
+// staticResults are the results of staticMethods, by method.
+type staticResults map[string]json.RawMessage
+
+// learn fetches the results of staticMethods from u, unless they are already
+// known. Methods the upstream doesn't support are left out. They are learned
+// again after the upstream leaves rotation, since it may have been replaced.
+func (u *upstream) learn(ctx context.Context) error {
+	if u.static.Load() != nil {
+		return nil
+	}
+	results := make([]json.RawMessage, len(staticMethods))
+	batch := make([]rpc.BatchElem, len(staticMethods))
+	for i, m := range staticMethods {
+		batch[i] = rpc.BatchElem{Method: m, Result: &results[i]}
+	}
+	if err := u.client.BatchCallContext(ctx, batch); err != nil {
+		return err
+	}
+	static := make(staticResults, len(batch))
+	for i, b := range batch {
+		if b.Error == nil && len(results[i]) > 0 {
+			static[b.Method] = results[i]
+		}
+	}
+	u.static.Store(&static)
+	return nil
+}
+
+// staticResult returns the result of method from an available upstream of
+// pool, or false if it isn't static or isn't known yet.
+func (st *settings) staticResult(pool *upstreams, method string) (json.RawMessage, bool) {
+	if method == "web3_clientVersion" && st.clientVersion != nil {
+		return st.clientVersion, true
+	}
+	for _, u := range pool.list {
+		if !u.available() {
+			continue
+		}
+		if static := u.static.Load(); static != nil {
+			result, ok := (*static)[method]
+			return result, ok
+		}
+	}
+	return nil, false
+}
+
+// fromStatic fills in the responses of requests for static methods, and
+// returns how many there were. Requests which already have a response are
+// skipped.
+func (t *myTransport) fromStatic(ctx context.Context, parsedRequests []ModifiedRequest, responses []json.RawMessage) int {
+	st := t.settings()
+	var n int
+	for i, r := range parsedRequests {
+		if responses[i] != nil || len(r.ID) == 0 || len(r.Params) > 0 {
+			continue
+		}
+		if result, ok := st.staticResult(t.route(ctx, r), r.Path); ok {
+			responses[i] = mustMarshal(jsonRPCResult(r.ID, result))
+			n++
+		}
+	}
+	return n
+}
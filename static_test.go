@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+func TestStatic(t *testing.T) {
+	node := newFakeNode(t, nodeResults("0x10"))
+	node.set("eth_chainId", "0x3c")
+	node.set("web3_clientVersion", "GoChain/v3.0.0")
+	node.set("eth_call", "0x1")
+	s := testServer(t, ConfigData{
+		URL:   node.URL,
+		Allow: []string{"eth_chainId", "net_version", "web3_clientVersion", "rpc_modules", "eth_call"},
+	})
+	if _, _, err := s.latestBlock.update(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		method, result string
+	}{
+		{"eth_chainId", `"0x3c"`},
+		{"net_version", `"60"`},
+		{"web3_clientVersion", `"GoChain/v3.0.0"`},
+	} {
+		calls := node.called(tc.method)
+		w := postRPC(s, `{"jsonrpc":"2.0","id":7,"method":"`+tc.method+`","params":[]}`)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"id":7`) || !strings.Contains(w.Body.String(), tc.result) {
+			t.Errorf("%s: unexpected response %d: %s", tc.method, w.Code, w.Body)
+		}
+		if node.called(tc.method) != calls {
+			t.Errorf("%s: expected to be answered locally", tc.method)
+		}
+	}
+	// Unsupported methods are still forwarded.
+	if w := postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"rpc_modules","params":[]}`); !strings.Contains(w.Body.String(), "method not found") {
+		t.Errorf("expected upstream error but got %s", w.Body)
+	}
+
+	w := postRPC(s, `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]},{"jsonrpc":"2.0","id":2,"method":"eth_call","params":[]}]`)
+	var resps []resultResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resps); err != nil || len(resps) != 2 {
+		t.Fatalf("unexpected batch response %d: %s", w.Code, w.Body)
+	}
+	if string(resps[0].Result) != `"0x3c"` || string(resps[1].Result) != `"0x1"` {
+		t.Errorf("unexpected batch response %s", w.Body)
+	}
+	if calls := node.called("eth_chainId"); calls != 1 {
+		t.Errorf("expected eth_chainId to be fetched once but got %d", calls)
+	}
+
+	// The client version can be hidden.
+	if err := s.reload(&ConfigData{URL: node.URL, Allow: []string{"web3_clientVersion"}, ClientVersion: "rpc-proxy"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := postRPC(s, `{"jsonrpc":"2.0","id":1,"method":"web3_clientVersion","params":[]}`); !strings.Contains(w.Body.String(), `"rpc-proxy"`) {
+		t.Errorf("expected overridden client version but got %s", w.Body)
+	}
+
+	// Results are learned again once an upstream returns to rotation.
+	up := s.settings().upstreams.list[0]
+	if up.static.Load() == nil {
+		t.Fatal("expected static results to be kept on reload")
+	}
+	up.setHealthy(context.Background(), false, "test")
+	if up.static.Load() != nil {
+		t.Error("expected static results to be forgotten")
+	}
+}
+
+// newFakeWSNode serves node over a websocket.
+func newFakeWSNode(t *testing.T, node *fakeNode) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if isBatch(msg) {
+				var reqs []fakeRequest
+				json.Unmarshal(msg, &reqs)
+				var resps []interface{}
+				for _, req := range reqs {
+					resps = append(resps, node.respond(req))
+				}
+				conn.WriteJSON(resps)
+				continue
+			}
+			var req fakeRequest
+			json.Unmarshal(msg, &req)
+			conn.WriteJSON(node.respond(req))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestStatic_hiddenVersion(t *testing.T) {
+	node := newFakeNode(t, nodeResults("0x10"))
+	node.set("web3_clientVersion", "Geth/v1.0.0")
+	node.set("eth_call", "0x1")
+	ws := newFakeWSNode(t, node)
+	s := testServer(t, ConfigData{
+		Upstreams:     []UpstreamConfig{{URL: node.URL, WSURL: "ws" + strings.TrimPrefix(ws.URL, "http")}},
+		Allow:         []string{"web3_clientVersion", "eth_call"},
+		ClientVersion: "rpc-proxy",
+	})
+
+	// Homepage examples.
+	r := chi.NewRouter()
+	r.Get("/x/{method}", s.Example)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/x/web3_clientVersion", nil))
+	if !strings.Contains(w.Body.String(), "rpc-proxy") || strings.Contains(w.Body.String(), "Geth") {
+		t.Errorf("expected example with hidden version but got %s", w.Body)
+	}
+
+	proxy := httptest.NewServer(http.HandlerFunc(s.WSProxy))
+	defer proxy.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, msg := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"web3_clientVersion","params":[]}`,
+		// Forwarded with eth_call, and rewritten.
+		`[{"jsonrpc":"2.0","id":2,"method":"web3_clientVersion","params":[]},{"jsonrpc":"2.0","id":3,"method":"eth_call","params":[]}]`,
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		_, resp, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(resp), `"rpc-proxy"`) || strings.Contains(string(resp), "Geth") {
+			t.Errorf("expected hidden version but got %s", resp)
+		}
+	}
+	if node.called("web3_clientVersion") != 1 {
+		t.Errorf("expected a single forwarded web3_clientVersion but got %d", node.called("web3_clientVersion"))
+	}
+}
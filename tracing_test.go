@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	if _, err := setupTracing(context.Background(), "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	node := newFakeNode(t, map[string]interface{}{"eth_call": "0x1"})
+	var mu sync.Mutex
+	var traceparents []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		mu.Unlock()
+		node.serve(w, r)
+	}))
+	defer upstream.Close()
+	s := testServer(t, ConfigData{URL: upstream.URL, Allow: []string{"eth_call"}})
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID, traceRequests)
+	r.HandleFunc("/*", s.RPCProxy)
+	r.HandleFunc("/v1/{key}", s.RPCProxy)
+	h := http.Handler(r)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[]}`))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
+	}
+	root, ok := spans["POST /*"]
+	if !ok {
+		t.Fatalf("expected a span for the incoming request, got %v", spans)
+	}
+	if !hasAttribute(root.Attributes(), "request.id") {
+		t.Error("expected request id attribute")
+	}
+	for _, name := range []string{"parse", "check", "upstream"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("expected a %s span", name)
+			continue
+		}
+		if s.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("expected %s span to be part of the request trace", name)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(traceparents) != 1 || !strings.Contains(traceparents[0], spans["upstream"].SpanContext().SpanID().String()) {
+		t.Errorf("expected traceparent of the upstream span to be sent upstream, got %v", traceparents)
+	}
+
+	// API keys are not exported.
+	rec.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/secret", strings.NewReader(`{}`)))
+	if ended := rec.Ended(); len(ended) == 0 || ended[len(ended)-1].Name() != "POST /v1/{key}" {
+		t.Errorf("expected a span named by route, got %v", ended)
+	}
+	for _, s := range rec.Ended() {
+		if strings.Contains(s.Name(), "secret") {
+			t.Errorf("expected span name without the key but got %s", s.Name())
+		}
+		for _, a := range s.Attributes() {
+			if strings.Contains(a.Value.Emit(), "secret") {
+				t.Errorf("expected attributes without the key but got %s=%s", a.Key, a.Value.Emit())
+			}
+		}
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, key attribute.Key) bool {
+	for _, a := range attrs {
+		if a.Key == key && a.Value.AsString() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSetupTracing_otlp(t *testing.T) {
+	var mu sync.Mutex
+	var exports int
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			mu.Lock()
+			exports++
+			mu.Unlock()
+		}
+	}))
+	defer collector.Close()
+
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	shutdown, err := setupTracing(context.Background(), collector.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := tracer().Start(context.Background(), "test", trace.WithAttributes(attribute.String("k", "v")))
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if exports == 0 {
+		t.Error("expected spans to be exported to the collector")
+	}
+}
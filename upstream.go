@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gochain/gochain/v3/rpc"
+	"github.com/treeder/gotils/v2"
+)
+
+// Load balancing strategies.
+const (
+	balanceRoundRobin    = "round-robin"
+	balanceLeastInFlight = "least-in-flight"
+	balanceWeighted      = "weighted"
+)
+
+// UpstreamConfig describes a single backend node.
+type UpstreamConfig struct {
+	URL    string `toml:",omitempty"`
+	WSURL  string `toml:",omitempty"`
+	Weight int    `toml:",omitempty"` // Only used by the weighted strategy. 0 means 1.
+}
+
+type upstream struct {
+	url    *url.URL
+	wsURL  *url.URL // nil when the node does not serve websockets.
+	weight int
+
+	inFlight  int64  // atomic
+	unhealthy int32  // atomic, set while out of rotation.
+	head      uint64 // atomic, as of the last health check.
+
+	static atomic.Pointer[staticResults] // nil until learned by a health check.
+
+	client  *rpc.Client // Used for health checks.
+	breaker *breaker    // nil disables.
+
+	current int // Smooth weighted round-robin state, protected by upstreams.mu.
+}
+
+func newUpstream(cfg UpstreamConfig) (*upstream, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("upstream url is required")
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	up := &upstream{url: u, weight: cfg.Weight}
+	if cfg.WSURL != "" {
+		up.wsURL, err = url.Parse(cfg.WSURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if up.weight < 0 {
+		return nil, fmt.Errorf("upstream %s: negative weight: %d", cfg.URL, cfg.Weight)
+	} else if up.weight == 0 {
+		up.weight = 1
+	}
+	return up, nil
+}
+
+func (u *upstream) String() string {
+	return u.url.String()
+}
+
+// target returns in rewritten to the scheme, host and base path of the upstream.
+func (u *upstream) target(in *url.URL) *url.URL {
+	out := *in
+	out.Scheme = u.url.Scheme
+	out.Host = u.url.Host
+	out.Path, out.RawPath = joinURLPath(u.url, in)
+	if u.url.RawQuery == "" || in.RawQuery == "" {
+		out.RawQuery = u.url.RawQuery + in.RawQuery
+	} else {
+		out.RawQuery = u.url.RawQuery + "&" + in.RawQuery
+	}
+	return &out
+}
+
+// wsTarget returns the websocket URL for the incoming request, or nil if the
+// upstream has none.
+func (u *upstream) wsTarget(in *url.URL) *url.URL {
+	if u.wsURL == nil {
+		return nil
+	}
+	// Shallow copy
+	out := *u.wsURL
+	out.Fragment = in.Fragment
+	out.Path = in.Path
+	out.RawQuery = in.RawQuery
+	return &out
+}
+
+// report records the result of a request for the circuit breaker.
+func (u *upstream) report(ctx context.Context, success bool) {
+	if state, changed := u.breaker.record(success); changed {
+		gotils.L(ctx).Info().Printf("Upstream %s circuit %s", u, state)
+	}
+}
+
+func (u *upstream) acquire() { atomic.AddInt64(&u.inFlight, 1) }
+func (u *upstream) release() { atomic.AddInt64(&u.inFlight, -1) }
+
+// releaseBody wraps a response body and releases its upstream once closed.
+type releaseBody struct {
+	io.ReadCloser
+	once sync.Once
+	up   *upstream
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(b.up.release)
+	return b.ReadCloser.Close()
+}
+
+// trackResponse holds the in-flight slot of u until the response body is closed.
+func (u *upstream) trackResponse(resp *http.Response, err error) (*http.Response, error) {
+	if err != nil || resp == nil || resp.Body == nil {
+		u.release()
+		return resp, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, up: u}
+	return resp, nil
+}
+
+// upstreams is a set of backend nodes and the strategy used to choose between them.
+type upstreams struct {
+	name        string
+	list        []*upstream
+	strategy    string
+	maxBlockLag uint64
+
+	netVersion string // Expected network, held by most upstreams at the last health check.
+
+	next uint64 // atomic round-robin counter
+
+	mu sync.Mutex // Protects weighted state.
+}
+
+func newUpstreams(cfgs []UpstreamConfig, strategy string, maxBlockLag uint64) (*upstreams, error) {
+	switch strategy {
+	case "":
+		strategy = balanceRoundRobin
+	case balanceRoundRobin, balanceLeastInFlight, balanceWeighted:
+	default:
+		return nil, fmt.Errorf("unknown balance strategy: %q", strategy)
+	}
+	if len(cfgs) == 0 {
+		return nil, fmt.Errorf("no upstreams configured")
+	}
+	us := &upstreams{strategy: strategy, maxBlockLag: maxBlockLag}
+	for _, c := range cfgs {
+		u, err := newUpstream(c)
+		if err != nil {
+			return nil, err
+		}
+		us.list = append(us.list, u)
+	}
+	return us, nil
+}
+
+// pick returns the next healthy upstream according to the strategy, skipping
+// any in exclude and any with an open circuit. Unhealthy upstreams are only
+// used as a last resort, when none are healthy. Returns nil if no upstream is
+// left. The result of a request sent to the upstream must be reported.
+func (us *upstreams) pick(exclude ...*upstream) *upstream {
+	for {
+		u := us.choose(exclude)
+		if u == nil || u.breaker.allow() {
+			return u
+		}
+		// Lost the half-open probe to another request.
+		exclude = append(exclude[:len(exclude):len(exclude)], u)
+	}
+}
+
+func (us *upstreams) choose(exclude []*upstream) *upstream {
+	candidates := make([]*upstream, 0, len(us.list))
+	anyAvailable := false
+	for _, u := range us.list {
+		if !u.available() {
+			continue
+		}
+		anyAvailable = true
+		if !containsUpstream(exclude, u) && u.breaker.ready() {
+			candidates = append(candidates, u)
+		}
+	}
+	if !anyAvailable {
+		for _, u := range us.list {
+			if !containsUpstream(exclude, u) && u.breaker.ready() {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch us.strategy {
+	case balanceLeastInFlight:
+		// Ties are broken round-robin so idle nodes share the load.
+		start := int(atomic.AddUint64(&us.next, 1) % uint64(len(candidates)))
+		best := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			c := candidates[(start+i)%len(candidates)]
+			if atomic.LoadInt64(&c.inFlight) < atomic.LoadInt64(&best.inFlight) {
+				best = c
+			}
+		}
+		return best
+	case balanceWeighted:
+		// Smooth weighted round-robin, as used by nginx.
+		us.mu.Lock()
+		defer us.mu.Unlock()
+		var best *upstream
+		total := 0
+		for _, c := range candidates {
+			c.current += c.weight
+			total += c.weight
+			if best == nil || c.current > best.current {
+				best = c
+			}
+		}
+		best.current -= total
+		return best
+	default:
+		return candidates[atomic.AddUint64(&us.next, 1)%uint64(len(candidates))]
+	}
+}
+
+func containsUpstream(list []*upstream, u *upstream) bool {
+	for _, l := range list {
+		if l == u {
+			return true
+		}
+	}
+	return false
+}
+
+// joinURLPath joins the paths of a and b, as done by httputil.NewSingleHostReverseProxy.
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+	return a.Path + b.Path, apath + bpath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
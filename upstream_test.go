@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func testUpstreams(t *testing.T, strategy string, cfgs ...UpstreamConfig) *upstreams {
+	t.Helper()
+	us, err := newUpstreams(cfgs, strategy, defaultMaxBlockLag)
+	if err != nil {
+		t.Fatalf("failed to create upstreams: %v", err)
+	}
+	return us
+}
+
+func TestUpstreams_roundRobin(t *testing.T) {
+	us := testUpstreams(t, balanceRoundRobin, UpstreamConfig{URL: "http://a"}, UpstreamConfig{URL: "http://b"})
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		counts[us.pick().url.Host]++
+	}
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Errorf("expected even distribution but got: %v", counts)
+	}
+}
+
+func TestUpstreams_weighted(t *testing.T) {
+	us := testUpstreams(t, balanceWeighted, UpstreamConfig{URL: "http://a", Weight: 3}, UpstreamConfig{URL: "http://b"})
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		counts[us.pick().url.Host]++
+	}
+	if counts["a"] != 6 || counts["b"] != 2 {
+		t.Errorf("expected 3:1 distribution but got: %v", counts)
+	}
+}
+
+func TestUpstreams_leastInFlight(t *testing.T) {
+	us := testUpstreams(t, balanceLeastInFlight, UpstreamConfig{URL: "http://a"}, UpstreamConfig{URL: "http://b"})
+	us.list[0].acquire()
+	for i := 0; i < 4; i++ {
+		if u := us.pick(); u != us.list[1] {
+			t.Fatalf("expected least loaded upstream b but got: %s", u)
+		}
+	}
+	us.list[0].release()
+}
+
+func TestUpstreams_exclude(t *testing.T) {
+	us := testUpstreams(t, balanceRoundRobin, UpstreamConfig{URL: "http://a"}, UpstreamConfig{URL: "http://b"})
+	for i := 0; i < 4; i++ {
+		if u := us.pick(us.list[0]); u != us.list[1] {
+			t.Fatalf("expected upstream b but got: %s", u)
+		}
+	}
+	if u := us.pick(us.list...); u != nil {
+		t.Errorf("expected no upstream but got: %s", u)
+	}
+}
+
+func TestUpstreams_invalid(t *testing.T) {
+	if _, err := newUpstreams([]UpstreamConfig{{URL: "http://a"}}, "random", 0); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+	if _, err := newUpstreams(nil, "", 0); err == nil {
+		t.Error("expected error for no upstreams")
+	}
+	if _, err := newUpstreams([]UpstreamConfig{{URL: "http://a", Weight: -1}}, "", 0); err == nil {
+		t.Error("expected error for negative weight")
+	}
+}
+
+func TestUpstream_target(t *testing.T) {
+	u, err := newUpstream(UpstreamConfig{URL: "http://node:8040/rpc?key=1", WSURL: "ws://node:8041"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, _ := url.Parse("http://proxy/path?a=b")
+	if have, want := u.target(in).String(), "http://node:8040/rpc/path?key=1&a=b"; have != want {
+		t.Errorf("want %s but have %s", want, have)
+	}
+	if have, want := u.wsTarget(in).String(), "ws://node:8041/path?a=b"; have != want {
+		t.Errorf("want %s but have %s", want, have)
+	}
+}
@@ -2,15 +2,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/gorilla/websocket"
 	"github.com/treeder/gotils/v2"
 )
@@ -39,10 +45,10 @@ type WebsocketProxy struct {
 	// which will be forwarded to another server.
 	Director func(incoming *http.Request, out http.Header)
 
-	// Backend returns the backend URL which the proxy uses to reverse proxy
+	// Backend returns the upstream which the proxy uses to reverse proxy
 	// the incoming WebSocket connection. Request is the initial incoming and
 	// unmodified request.
-	Backend func(*http.Request) *url.URL
+	Backend func(*http.Request) *upstream
 
 	// Upgrader specifies the parameters for upgrading a incoming HTTP
 	// connection to a WebSocket connection. If nil, DefaultUpgrader is used.
@@ -53,18 +59,170 @@ type WebsocketProxy struct {
 	Dialer *websocket.Dialer
 
 	Transport *myTransport
+
+	sessions wsSessions
+}
+
+// wsSession is an open websocket connection.
+type wsSession struct {
+	requestID string
+	ip        string
+	apiKey    string
+	upstream  string
+	started   time.Time
+
+	subscriptions int64 // atomic, eth_subscribe calls less eth_unsubscribe calls.
+
+	mu         sync.Mutex          // Protects versionIDs.
+	versionIDs map[string]struct{} // Ids of forwarded web3_clientVersion requests.
+}
+
+// count tracks subscriptions made or cancelled by reqs.
+func (s *wsSession) count(reqs []ModifiedRequest) {
+	for _, r := range reqs {
+		switch r.Path {
+		case "eth_subscribe":
+			atomic.AddInt64(&s.subscriptions, 1)
+		case "eth_unsubscribe":
+			if atomic.AddInt64(&s.subscriptions, -1) < 0 {
+				atomic.AddInt64(&s.subscriptions, 1)
+			}
+		}
+	}
+}
+
+// forwardVersion remembers the ids of web3_clientVersion requests in reqs, so
+// the upstream's version can be hidden from their responses.
+func (s *wsSession) forwardVersion(reqs []ModifiedRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range reqs {
+		if r.Path != "web3_clientVersion" || len(r.ID) == 0 {
+			continue
+		}
+		if s.versionIDs == nil {
+			s.versionIDs = make(map[string]struct{})
+		}
+		s.versionIDs[compactID(r.ID)] = struct{}{}
+	}
+}
+
+// hideVersion returns msg from the upstream with the results of
+// web3_clientVersion requests replaced by version.
+func (s *wsSession) hideVersion(msg []byte, version json.RawMessage) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.versionIDs) == 0 {
+		return msg
+	}
+	var resps []map[string]json.RawMessage
+	batch := isBatch(msg)
+	if batch {
+		if err := json.Unmarshal(msg, &resps); err != nil {
+			return msg
+		}
+	} else {
+		var resp map[string]json.RawMessage
+		if err := json.Unmarshal(msg, &resp); err != nil {
+			return msg
+		}
+		resps = append(resps, resp)
+	}
+	var changed bool
+	for _, resp := range resps {
+		id, ok := resp["id"]
+		if !ok {
+			continue
+		}
+		if _, ok := s.versionIDs[compactID(id)]; !ok {
+			continue
+		}
+		delete(s.versionIDs, compactID(id))
+		if _, ok := resp["result"]; ok && version != nil {
+			resp["result"] = version
+			changed = true
+		}
+	}
+	if !changed {
+		return msg
+	} else if batch {
+		return mustMarshal(resps)
+	}
+	return mustMarshal(resps[0])
+}
+
+func compactID(id json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, id); err != nil {
+		return string(id)
+	}
+	return buf.String()
+}
+
+// wsSessions is the set of open websocket connections.
+type wsSessions struct {
+	mu sync.Mutex
+	m  map[*wsSession]struct{}
+}
+
+func (ss *wsSessions) add(s *wsSession) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.m == nil {
+		ss.m = make(map[*wsSession]struct{})
+	}
+	ss.m[s] = struct{}{}
+}
+
+func (ss *wsSessions) remove(s *wsSession) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.m, s)
+}
+
+// wsSessionInfo describes an open websocket connection.
+type wsSessionInfo struct {
+	RequestID     string    `json:"requestId"`
+	IP            string    `json:"ip"`
+	APIKey        string    `json:"apiKey,omitempty"`
+	Upstream      string    `json:"upstream"`
+	Started       time.Time `json:"started"`
+	Subscriptions int64     `json:"subscriptions"`
+}
+
+// list returns the open connections, oldest first.
+func (ss *wsSessions) list() []wsSessionInfo {
+	ss.mu.Lock()
+	list := make([]wsSessionInfo, 0, len(ss.m))
+	for s := range ss.m {
+		list = append(list, wsSessionInfo{
+			RequestID:     s.requestID,
+			IP:            s.ip,
+			APIKey:        s.apiKey,
+			Upstream:      s.upstream,
+			Started:       s.started,
+			Subscriptions: atomic.LoadInt64(&s.subscriptions),
+		})
+	}
+	ss.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
 }
 
 // NewProxy returns a new Websocket reverse proxy that rewrites the
-// URL's to the scheme, host and base path provider in target.
-func NewProxy(target *url.URL) *WebsocketProxy {
-	backend := func(r *http.Request) *url.URL {
-		// Shallow copy
-		u := *target
-		u.Fragment = r.URL.Fragment
-		u.Path = r.URL.Path
-		u.RawQuery = r.URL.RawQuery
-		return &u
+// URL's to the scheme, host and base path of an upstream chosen from the
+// pool returned by ups.
+func NewProxy(ups func() *upstreams) *WebsocketProxy {
+	backend := func(r *http.Request) *upstream {
+		pool := ups()
+		var tried []*upstream
+		for {
+			u := pool.pick(tried...)
+			if u == nil || u.wsURL != nil {
+				return u
+			}
+			tried = append(tried, u)
+		}
 	}
 	return &WebsocketProxy{Backend: backend}
 }
@@ -78,12 +236,15 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	backendURL := w.Backend(req)
-	if backendURL == nil {
-		gotils.L(ctx).Error().Print("websocketproxy: backend URL is nil")
-		http.Error(rw, "internal server error (code: 2)", http.StatusInternalServerError)
+	backend := w.Backend(req)
+	if backend == nil {
+		gotils.L(ctx).Error().Print("websocketproxy: no backend available")
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 		return
 	}
+	backendURL := backend.wsTarget(req.URL)
+	backend.acquire()
+	defer backend.release()
 
 	dialer := w.Dialer
 	if w.Dialer == nil {
@@ -141,6 +302,8 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// optional:
 	// http://tools.ietf.org/html/draft-ietf-hybi-websocket-multiplexing-01
 	connBackend, resp, err := dialer.Dial(backendURL.String(), requestHeader)
+	// Rejected handshakes are not the backend's fault.
+	backend.report(ctx, err == nil || (resp != nil && resp.StatusCode < 500))
 	if err != nil {
 		gotils.L(ctx).Error().Printf("websocketproxy:%s", err)
 		if resp != nil {
@@ -179,13 +342,56 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	defer connPub.Close()
+	defer w.Transport.metrics.wsConnected()()
 
+	ip := w.Transport.getIP(req)
+	reqID := middleware.GetReqID(ctx)
+	session := &wsSession{requestID: reqID, ip: ip, upstream: backend.url.Host, started: time.Now()}
+	if key := apiKeyFrom(ctx); key != nil {
+		session.apiKey = key.name
+	}
+	w.sessions.add(session)
+	defer w.sessions.remove(session)
 	errClient := make(chan error, 1)
 	errBackend := make(chan error, 1)
-	replicateWebsocketConn := func(ctx context.Context, ip string, limit bool, dst, src *websocket.Conn, errc chan error) {
+	pub, back := &wsConn{Conn: connPub}, &wsConn{Conn: connBackend}
+	newEntry := func(bytesIn int64) *accessLogEntry {
+		entry := &accessLogEntry{
+			Time:      time.Now(),
+			RequestID: reqID,
+			Transport: "ws",
+			IP:        ip,
+			Upstreams: []string{backend.url.Host},
+			BytesIn:   bytesIn,
+		}
+		if key := apiKeyFrom(ctx); key != nil {
+			entry.APIKey = key.name
+		}
+		return entry
+	}
+	// rejectLimit answers a message over the request limits, but keeps the connection.
+	rejectLimit := func(ctx context.Context, src *wsConn, entry *accessLogEntry, le *limitError) error {
+		gotils.L(ctx).Info().Printf("Request blocked: %v", le)
+		w.Transport.metrics.rejected(rejectRequestLimit)
+		entry.Status, entry.ErrorCode = le.httpCode, jsonRPCInvalidRequest
+		w.Transport.accessLog.log(entry)
+		return src.writeJSON(le.response())
+	}
+	replicateWebsocketConn := func(ctx context.Context, ip string, limit bool, dst, src *wsConn, errc chan error) {
 		for {
-			msgType, msg, err := src.ReadMessage()
-			if err != nil {
+			var lim requestLimits
+			if limit {
+				lim = w.Transport.settings().requestLimits
+			}
+			msgType, msg, err := lim.readMessage(src.Conn)
+			if le, ok := err.(*limitError); ok {
+				entry := newEntry(lim.maxBodyBytes + 1)
+				if err := rejectLimit(ctx, src, entry, le); err != nil {
+					errc <- err
+					break
+				}
+				continue
+			} else if err != nil {
 				gotils.L(ctx).Error().Printf("websocketproxy: ReadMessage %s", err)
 				m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err))
 				if e, ok := err.(*websocket.CloseError); ok {
@@ -198,8 +404,19 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				break
 			}
 			if limit && len(msg) > 0 {
-				methods, res, err := parseMessage(msg, ip)
-				if err != nil {
+				entry := newEntry(int64(len(msg)))
+				methods, res, err := parseMessage(msg, ip, lim)
+				entry.Methods = methods
+				if isBatch(msg) {
+					entry.BatchSize = len(methods)
+				}
+				if le, ok := err.(*limitError); ok {
+					if err := rejectLimit(ctx, src, entry, le); err != nil {
+						errc <- err
+						break
+					}
+					continue
+				} else if err != nil {
 					errc <- err
 					err = src.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("%v", err)))
 					if err != nil {
@@ -209,9 +426,15 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				}
 				ctx = gotils.With(ctx, "remoteIp", ip)
 				ctx = gotils.With(ctx, "methods", methods)
+				if key := apiKeyFrom(ctx); key != nil {
+					ctx = gotils.With(ctx, "apiKey", key.name)
+					setKey(res, key)
+				}
 				if len(methods) > 0 {
-					_, resp := w.Transport.block(ctx, res)
+					code, resp := w.Transport.block(ctx, res)
 					if resp != nil {
+						entry.Status, entry.ErrorCode = code, resp.(ErrResponse).Error.Code
+						w.Transport.accessLog.log(entry)
 						errc <- errors.New(resp.(ErrResponse).Error.Message)
 						err = src.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, resp.(ErrResponse).Error.Message))
 						if err != nil {
@@ -220,6 +443,27 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 						break
 					}
 				}
+				// Static methods are answered locally when the whole message can be.
+				responses := make([]json.RawMessage, len(res))
+				if len(methods) > 0 && w.Transport.fromStatic(ctx, res, responses) == len(res) {
+					w.Transport.accessLog.log(entry)
+					out := responses[0]
+					if isBatch(msg) {
+						out = mustMarshal(responses)
+					}
+					if err := src.WriteMessage(websocket.TextMessage, out); err != nil {
+						errc <- err
+						break
+					}
+					continue
+				}
+				w.Transport.accessLog.log(entry)
+				session.count(res)
+				if w.Transport.settings().clientVersion != nil {
+					session.forwardVersion(res)
+				}
+			} else if !limit && msgType == websocket.TextMessage {
+				msg = session.hideVersion(msg, w.Transport.settings().clientVersion)
 			}
 			if len(msg) == 0 { //workaround for empty message and a wrong type
 				if limit {
@@ -235,9 +479,8 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			}
 		}
 	}
-	ip := getIP(req)
-	go replicateWebsocketConn(ctx, ip, true, connBackend, connPub, errBackend)
-	go replicateWebsocketConn(ctx, ip, false, connPub, connBackend, errClient)
+	go replicateWebsocketConn(ctx, ip, true, back, pub, errBackend)
+	go replicateWebsocketConn(ctx, ip, false, pub, back, errClient)
 
 	var message string
 	select {
@@ -252,6 +495,27 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// wsConn serializes writes to a websocket connection, since both directions
+// of the proxy may write to it.
+type wsConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *wsConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+func (c *wsConn) writeJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.TextMessage, b)
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {